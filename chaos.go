@@ -0,0 +1,61 @@
+package reroutine
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrChaosDisabled is returned by InjectPanic unless EnableChaos was called.
+var ErrChaosDisabled = errors.New("reroutine: chaos is not enabled")
+
+var chaosEnabled int32
+
+// EnableChaos allows panics to be injected with InjectPanic, for chaos testing
+// of supervision in staging. It can't be disabled again, and should never be
+// called in production.
+func EnableChaos() {
+	atomic.StoreInt32(&chaosEnabled, 1)
+}
+
+func chaos() bool {
+	return atomic.LoadInt32(&chaosEnabled) == 1
+}
+
+// injection is a panic value injected with InjectPanic.
+type injection struct {
+	v interface{}
+}
+
+// InjectPanic makes the worker panic with v, exercising the same handling,
+// restart and backoff paths as a real panic. The running invocation panics
+// once it returns, and the context passed to the worker of GoContext and
+// BlockingGoContext is cancelled for it to do so promptly. If no invocation is
+// running, the next one panics before the worker is called. Panics injected
+// before the previous one happened replace it. It returns ErrChaosDisabled
+// unless EnableChaos was called.
+func (s *Supervisor) InjectPanic(v interface{}) error {
+	if !chaos() {
+		return ErrChaosDisabled
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.injected = &injection{v: v}
+	if s.cancelInvocation != nil {
+		s.cancelInvocation()
+	}
+	return nil
+}
+
+// panicInjected panics with the value injected with InjectPanic, if any.
+func (s *Supervisor) panicInjected() {
+	if !chaos() {
+		return
+	}
+	s.m.Lock()
+	i := s.injected
+	s.injected = nil
+	s.m.Unlock()
+	if i != nil {
+		panic(i.v)
+	}
+}
@@ -0,0 +1,43 @@
+package reroutine
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHandle_InjectPanic(t *testing.T) {
+	captureLogs(t)
+	h := GoContext(context.Background(), func(ctx context.Context) {
+		<-ctx.Done()
+	})
+	<-h.Started()
+	if err := h.InjectPanic("injected"); err != ErrChaosDisabled {
+		t.Errorf("expected chaos to be disabled by default, got %v", err)
+	}
+	h.Stop()
+	h.Wait()
+
+	EnableChaos()
+	defer atomic.StoreInt32(&chaosEnabled, 0)
+	var handled []interface{}
+	attempts := make(chan int, 2)
+	h = GoContext(context.Background(), func(ctx context.Context) {
+		attempts <- AttemptFromContext(ctx)
+		<-ctx.Done()
+	}, WithOnPanic(func(info PanicInfo) {
+		handled = append(handled, info.Value)
+	}))
+	<-attempts
+	if err := h.InjectPanic("injected"); err != nil {
+		t.Fatal(err)
+	}
+	if attempt := <-attempts; attempt != 2 {
+		t.Errorf("expected the injected panic to restart the worker, got attempt %d", attempt)
+	}
+	h.Stop()
+	h.Wait()
+	if len(handled) != 1 || handled[0] != "injected" || h.Restarts() != 1 {
+		t.Errorf("expected the injected panic to be handled, got %v", handled)
+	}
+}
@@ -0,0 +1,45 @@
+package reroutine
+
+import "time"
+
+// Clock tells a supervisor the time and lets it wait, so that tests can control
+// time instead of relying on the wall clock. See WithClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer that fires once d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-shot timer created by a Clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered once the timer
+	// fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, reporting whether it was still
+	// pending.
+	Stop() bool
+}
+
+// realClock is the default Clock which uses the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
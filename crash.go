@@ -1,9 +1,12 @@
 package reroutine
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"runtime"
+	"net/http"
+	"reflect"
+	"sync"
 )
 
 var (
@@ -11,12 +14,39 @@ var (
 	// true. It's still exposed so components can optionally set to false
 	// to restore prior behavior.
 	ReallyCrash = false
-	PrintError  = func(str string) {
+	// PrintError logs the panics and restarts observed by supervisors. Setting
+	// it to nil disables logging.
+	PrintError = func(str string) {
 		log.Print(str)
 	}
+	// LogStackTrace controls whether the stack trace of the panicking
+	// go-routine is included when a panic is logged. Supervisors read it
+	// when they start and can override it with WithLogStackTrace.
+	LogStackTrace = true
 )
 
+var (
+	panicLogFormatM sync.Mutex
+	panicLogFormat  func(r interface{}, stack []byte) string
+)
+
+// SetPanicLogFormat replaces the format of the line logged by the default
+// logPanic handler, which is passed to PrintError, with the string returned by
+// format for the recovered value r and the stack trace, which is nil when
+// stack traces aren't logged. This allows emitting JSON, for example. Custom
+// formats don't include the restart decision that supervisors add to the
+// default format; use WithOnPanic for that. A nil format restores the default.
+func SetPanicLogFormat(format func(r interface{}, stack []byte) string) {
+	panicLogFormatM.Lock()
+	defer panicLogFormatM.Unlock()
+	panicLogFormat = format
+}
+
 // PanicHandlers is a list of functions which will be invoked when a panic happens.
+// They're always called in order, one after the other, and before any
+// additional handlers, so a handler can rely on the ones before it having run,
+// for example to redact a value before another handler forwards it. Nil
+// handlers are skipped.
 var PanicHandlers = []func(interface{}){logPanic}
 
 // HandleCrash simply catches a crash and logs an error. Meant to be called via
@@ -25,31 +55,138 @@ var PanicHandlers = []func(interface{}){logPanic}
 // handlers and logging the panic message.
 //
 // E.g., you can provide one or more additional handlers for something like shutting down go routines gracefully.
+// The additional handlers are called in order after the PanicHandlers.
 func HandleCrash(additionalHandlers ...func(interface{})) {
 	if r := recover(); r != nil {
-		for _, fn := range PanicHandlers {
-			fn(r)
+		handlePanic(r, ReallyCrash, nil, additionalHandlers)
+	}
+}
+
+// HandleCrashTransform is like HandleCrash but applies transform to the
+// recovered value once, before it is logged and passed to the handlers. See
+// WithRecoverTransform.
+func HandleCrashTransform(transform func(interface{}) interface{}, additionalHandlers ...func(interface{})) {
+	if r := recover(); r != nil {
+		handlePanic(transform(r), ReallyCrash, nil, additionalHandlers)
+	}
+}
+
+type panicHandlersKey struct{}
+
+// WithPanicHandlers returns a copy of ctx carrying handlers in addition to the
+// panic handlers already carried by ctx, if any. The handlers carried by a
+// context are run for panics recovered by HandleCrashCtx and by the
+// supervisors of GoContext, BlockingGoContext and Group.GoContext that are
+// given the context, after the global PanicHandlers and before any other
+// handlers. This lets request-scoped code attach handlers, such as
+// tenant-specific crash reporting, without changing the globals.
+func WithPanicHandlers(ctx context.Context, handlers ...func(interface{})) context.Context {
+	inherited := ContextPanicHandlers(ctx)
+	merged := make([]func(interface{}), 0, len(inherited)+len(handlers))
+	merged = append(append(merged, inherited...), handlers...)
+	return context.WithValue(ctx, panicHandlersKey{}, merged)
+}
+
+// ContextPanicHandlers returns the panic handlers carried by ctx, in the order
+// they were added with WithPanicHandlers.
+func ContextPanicHandlers(ctx context.Context) []func(interface{}) {
+	handlers, _ := ctx.Value(panicHandlersKey{}).([]func(interface{}))
+	return handlers
+}
+
+// HandleCrashCtx is like HandleCrash but also runs the panic handlers carried
+// by ctx, after the PanicHandlers and before additionalHandlers.
+func HandleCrashCtx(ctx context.Context, additionalHandlers ...func(interface{})) {
+	if r := recover(); r != nil {
+		handlers := append(ContextPanicHandlers(ctx), additionalHandlers...)
+		handlePanic(r, ReallyCrash, nil, handlers)
+	}
+}
+
+// handlePanic runs the handlers for the recovered value r, as runHandlers does,
+// and then re-panics with r if reallyCrash is set.
+func handlePanic(r interface{}, reallyCrash bool, log func(interface{}), additionalHandlers []func(interface{})) {
+	runHandlers(r, log, additionalHandlers)
+	if reallyCrash {
+		// Actually proceed to panic.
+		panic(r)
+	}
+}
+
+// runHandlers runs the PanicHandlers followed by additionalHandlers for the
+// recovered value r. If log isn't nil, it's called in place of the default
+// logPanic handler, which lets supervisors add their restart decision to the
+// default log line while still respecting callers that removed logPanic from
+// PanicHandlers.
+func runHandlers(r interface{}, log func(interface{}), additionalHandlers []func(interface{})) {
+	for _, fn := range PanicHandlers {
+		if fn == nil {
+			continue
 		}
-		for _, fn := range additionalHandlers {
+		if log != nil && isLogPanic(fn) {
+			log(r)
+		} else {
 			fn(r)
 		}
-		if ReallyCrash {
-			// Actually proceed to panic.
-			panic(r)
+	}
+	for _, fn := range additionalHandlers {
+		if fn != nil {
+			fn(r)
 		}
 	}
 }
 
+// isLogPanic reports whether fn is the default logPanic handler.
+func isLogPanic(fn func(interface{})) bool {
+	return reflect.ValueOf(fn).Pointer() == reflect.ValueOf(logPanic).Pointer()
+}
+
 // logPanic logs the caller tree when a panic occurs (except in the special case of http.ErrAbortHandler).
 func logPanic(r interface{}) {
-	// Same as stdlib http server code. Manually allocate stack trace buffer size
-	// to prevent excessively large logs
-	const size = 64 << 10
-	stacktrace := make([]byte, size)
-	stacktrace = stacktrace[:runtime.Stack(stacktrace, false)]
+	if r == http.ErrAbortHandler {
+		// Honor the http.ErrAbortHandler sentinel panic value, which is used
+		// to abort a request on purpose and shouldn't be logged.
+		return
+	}
+	var stack []byte
+	if LogStackTrace {
+		stack = captureStack()
+	}
+	logPanicNote(r, stack, "")
+}
+
+// logPanicNote is like logPanic but logs the provided stack, if any, and
+// appends note to the log line when it isn't empty.
+func logPanicNote(r interface{}, stack []byte, note string) {
+	printError(formatPanic(r, stack, note))
+}
+
+// printError calls PrintError with str, unless it's nil.
+func printError(str string) {
+	if fn := PrintError; fn != nil {
+		fn(str)
+	}
+}
+
+// formatPanic formats the line logged by logPanicNote.
+func formatPanic(r interface{}, stack []byte, note string) string {
+	panicLogFormatM.Lock()
+	format := panicLogFormat
+	panicLogFormatM.Unlock()
+	if format != nil {
+		return format(r, stack)
+	}
+	var msg string
 	if _, ok := r.(string); ok {
-		PrintError(fmt.Sprintf("Observed a panic: %s\n%s", r, stacktrace))
+		msg = fmt.Sprintf("Observed a panic: %s", r)
 	} else {
-		PrintError(fmt.Sprintf("Observed a panic: %#v (%v)\n%s", r, r, stacktrace))
+		msg = fmt.Sprintf("Observed a panic: %#v (%v)", r, r)
+	}
+	if note != "" {
+		msg += "; " + note
+	}
+	if stack != nil {
+		msg += "\n" + string(stack)
 	}
+	return msg
 }
@@ -1,10 +1,391 @@
 package reroutine
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLogPanic_Types(t *testing.T) {
 	logPanic("foobar")
 	logPanic(10)
 }
+
+// captureLogs replaces PrintError for the duration of the test and returns a
+// function reporting every line logged so far.
+func captureLogs(t testing.TB) func() []string {
+	var m sync.Mutex
+	var lines []string
+	original := PrintError
+	PrintError = func(str string) {
+		m.Lock()
+		defer m.Unlock()
+		lines = append(lines, str)
+	}
+	t.Cleanup(func() {
+		PrintError = original
+	})
+	return func() []string {
+		m.Lock()
+		defer m.Unlock()
+		return append([]string(nil), lines...)
+	}
+}
+
+func TestLogPanic_RestartDecision(t *testing.T) {
+	logs := captureLogs(t)
+	BlockingGo(make(chan struct{}), func() {
+		panic("panicked")
+	}, WithMaxRestarts(1))
+
+	lines := logs()
+	if len(lines) != 2 {
+		t.Fatalf("expected two log lines, got %d", len(lines))
+	}
+	if !strings.Contains(lines[0], "restarting (attempt 2)") {
+		t.Errorf("expected restart note, got %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "giving up (attempt 2)") {
+		t.Errorf("expected give up note, got %q", lines[1])
+	}
+}
+
+func TestLogPanic_RestartCountdown(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(v bool) { LogStackTrace = v }(LogStackTrace)
+	LogStackTrace = false
+	BlockingGo(make(chan struct{}), func() {
+		panic("panicked")
+	}, WithMaxRestarts(3))
+
+	expected := []string{
+		"Observed a panic: panicked; restarting (attempt 2); restart 1 of 3, 2 remaining",
+		"Observed a panic: panicked; restarting (attempt 3); restart 2 of 3, 1 remaining",
+		"Observed a panic: panicked; restarting (attempt 4); restart 3 of 3, 0 remaining",
+		"Observed a panic: panicked; giving up (attempt 4): max restarts exceeded after 4 attempts",
+	}
+	if lines := logs(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected the restarts to count down, got %q", lines)
+	}
+}
+
+func TestLogPanic_StackTrace(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(v bool) { LogStackTrace = v }(LogStackTrace)
+
+	LogStackTrace = false
+	logPanic("foobar")
+	LogStackTrace = true
+	logPanic("foobar")
+
+	lines := logs()
+	if strings.Contains(lines[0], "goroutine") {
+		t.Errorf("expected no stack trace, got %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "goroutine") {
+		t.Errorf("expected stack trace, got %q", lines[1])
+	}
+}
+
+func TestHandleCrashTransform(t *testing.T) {
+	logs := captureLogs(t)
+	var recovered interface{}
+	func() {
+		defer HandleCrashTransform(func(r interface{}) interface{} {
+			return strings.ReplaceAll(r.(string), "secret", "[redacted]")
+		}, func(r interface{}) {
+			recovered = r
+		})
+		panic("password is secret")
+	}()
+
+	if recovered != "password is [redacted]" {
+		t.Errorf("expected redacted value, got %v", recovered)
+	}
+	if lines := logs(); strings.Contains(lines[0], "secret") {
+		t.Errorf("expected redacted log, got %q", lines[0])
+	}
+}
+
+func TestLogPanic_RemovedFromPanicHandlers(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	PanicHandlers = nil
+
+	BlockingGo(make(chan struct{}), func() {
+		panic("panicked")
+	}, WithMaxRestarts(1))
+	if lines := logs(); len(lines) != 0 {
+		t.Errorf("expected no log lines, got %v", lines)
+	}
+}
+
+func TestLogPanic_NilHooks(t *testing.T) {
+	captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	PrintError = nil
+	PanicHandlers = []func(interface{}){nil, logPanic}
+	SetPanicLogFormat(nil)
+
+	BlockingGo(nil, func() {
+		func() {
+			defer HandleCrash(nil)
+			panic("handled")
+		}()
+		RunBestEffort(func() {
+			panic("best effort")
+		})
+		panic("panicked")
+	}, WithMaxRestarts(1), WithBackoff(0, 0), WithRepeatLogging(time.Hour, nil))
+
+	h := GoExitCode(nil, func(code int) bool {
+		return code != 0
+	}, func() int {
+		return 1
+	}, WithMaxRestarts(1), WithBackoff(0, 0))
+	h.Wait()
+	if h.Reason() != StopReasonMaxRestarts {
+		t.Errorf("expected supervision to give up as usual, got %v", h.Reason())
+	}
+}
+
+func TestLogPanic_GiveUpHandledBeforeReturn(t *testing.T) {
+	logs := captureLogs(t)
+	handled := int32(0)
+	BlockingGo(make(chan struct{}), func() {
+		panic("panicked")
+	}, WithMaxRestarts(0), WithRestartIf(func(interface{}) bool {
+		return false
+	}), WithOnPanic(func(PanicInfo) {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&handled, 1)
+	}))
+	if atomic.LoadInt32(&handled) != 1 || len(logs()) != 1 {
+		t.Error("expected the panic to be handled before BlockingGo returned")
+	}
+}
+
+func TestLogPanic_SupervisorStackTrace(t *testing.T) {
+	logs := captureLogs(t)
+	BlockingGo(make(chan struct{}), func() {
+		panic("panicked")
+	}, WithMaxRestarts(0), WithRestartIf(func(interface{}) bool {
+		return false
+	}), WithLogStackTrace(false))
+	if lines := logs(); len(lines) != 1 || strings.Contains(lines[0], "goroutine") {
+		t.Errorf("expected a single line without stack trace, got %v", lines)
+	}
+}
+
+func TestSetPanicLogFormat(t *testing.T) {
+	logs := captureLogs(t)
+	defer SetPanicLogFormat(nil)
+	SetPanicLogFormat(func(r interface{}, stack []byte) string {
+		return fmt.Sprintf(`{"panic":%q,"stack":%t}`, r, stack != nil)
+	})
+	func() {
+		defer HandleCrash()
+		panic("panicked")
+	}()
+	SetPanicLogFormat(nil)
+	func() {
+		defer HandleCrash()
+		panic("panicked")
+	}()
+	lines := logs()
+	if len(lines) != 2 || lines[0] != `{"panic":"panicked","stack":true}` || !strings.HasPrefix(lines[1], "Observed a panic: panicked") {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+}
+
+func TestHandleCrash_NoPanic(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	var called int32
+	handler := func(interface{}) {
+		atomic.AddInt32(&called, 1)
+	}
+	PanicHandlers = append(PanicHandlers, handler)
+	for _, fn := range []func(){
+		func() { defer HandleCrash(handler) },
+		func() { defer HandleCrashTransform(func(r interface{}) interface{} { return r }, handler) },
+	} {
+		fn()
+	}
+	if n := atomic.LoadInt32(&called); n != 0 {
+		t.Errorf("expected no handlers to run, got %d calls", n)
+	}
+	if lines := logs(); len(lines) != 0 {
+		t.Errorf("expected nothing to be logged, got %q", lines)
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		defer HandleCrash()
+	}); allocs != 0 {
+		t.Errorf("expected no allocations without a panic, got %v", allocs)
+	}
+}
+
+func BenchmarkHandleCrash_NoPanic(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		func() {
+			defer HandleCrash()
+		}()
+	}
+}
+
+func TestSupervisor_RepeatLogging(t *testing.T) {
+	logs := captureLogs(t)
+	clock := newFakeClock()
+	var repeats []string
+	i := 0
+	BlockingGo(nil, func() {
+		switch i++; i {
+		case 3:
+			// Start a new burst.
+			clock.Advance(time.Hour)
+			panic("panicked")
+		case 5:
+			return
+		default:
+			panic("panicked")
+		}
+	}, WithClock(clock), WithRepeatLogging(time.Minute, func(line string) {
+		repeats = append(repeats, line)
+	}))
+	lines := logs()
+	if len(lines) != 2 || !strings.Contains(lines[0], "\n") || !strings.Contains(lines[1], "restarting (attempt 4)") {
+		t.Errorf("expected the first panic of each burst to be logged in full, got %q", lines)
+	}
+	if len(repeats) != 2 || repeats[0] != "Observed a panic: panicked; restarting (attempt 3); repeat 1 within 1m0s" {
+		t.Errorf("expected repeats to be logged without their stack, got %q", repeats)
+	}
+}
+
+func TestSupervisor_SetVerbose(t *testing.T) {
+	logs := captureLogs(t)
+	var repeats []string
+	var s *Supervisor
+	i := 0
+	s = NewSupervisor(func() {
+		switch i++; i {
+		case 2:
+			s.SetVerbose(true)
+		case 3:
+			s.SetVerbose(false)
+		case 4:
+			return
+		}
+		panic("panicked")
+	}, WithInline(), WithLogStackTrace(false), WithRepeatLogging(time.Minute, func(line string) {
+		repeats = append(repeats, line)
+	}))
+	s.Run(nil)
+	lines := logs()
+	if len(lines) != 2 || strings.Contains(lines[0], "\n") {
+		t.Fatalf("expected the first panic without its stack and the verbose one, got %q", lines)
+	}
+	if strings.Count(lines[1], "\ngoroutine ") < 1 || !strings.Contains(lines[1], "restarting (attempt 3)") {
+		t.Errorf("expected the verbose panic to be logged with all stacks, got %q", lines[1])
+	}
+	if len(repeats) != 1 || !strings.Contains(repeats[0], "restarting (attempt 4); repeat 2") {
+		t.Errorf("expected throttling to resume once verbose logging is off, got %q", repeats)
+	}
+}
+
+func TestLogPanic_Filter(t *testing.T) {
+	logs := captureLogs(t)
+	func() {
+		defer HandleCrash()
+		panic(http.ErrAbortHandler)
+	}()
+	var handled []interface{}
+	i := 0
+	BlockingGo(nil, func() {
+		switch i++; i {
+		case 1:
+			panic(http.ErrAbortHandler)
+		case 2:
+			panic("benign")
+		case 3:
+			panic("logged")
+		}
+	}, WithLogFilter(func(r interface{}) bool {
+		return r != "benign"
+	}), WithOnPanic(func(info PanicInfo) {
+		handled = append(handled, info.Value)
+	}))
+	if lines := logs(); len(lines) != 1 || !strings.HasPrefix(lines[0], "Observed a panic: logged;") {
+		t.Errorf("expected only the unfiltered panic to be logged, got %q", lines)
+	}
+	if len(handled) != 3 || i != 4 {
+		t.Errorf("expected filtered panics to still be handled and restarted, got %v", handled)
+	}
+}
+
+func TestHandleCrash_HandlerOrder(t *testing.T) {
+	captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	var order []string
+	handler := func(name string) func(interface{}) {
+		return func(interface{}) {
+			order = append(order, name)
+		}
+	}
+	PanicHandlers = append(PanicHandlers, handler("global 1"), handler("global 2"))
+	func() {
+		defer HandleCrash(handler("additional 1"), handler("additional 2"))
+		panic("panicked")
+	}()
+	BlockingGo(nil, func() {
+		if len(order) < 5 {
+			panic("panicked")
+		}
+	}, WithOnPanic(func(PanicInfo) {
+		order = append(order, "on panic")
+	}))
+	expected := []string{"global 1", "global 2", "additional 1", "additional 2", "global 1", "global 2", "on panic"}
+	if strings.Join(order, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected handlers to run in order %q, got %q", expected, order)
+	}
+}
+
+func TestHandleCrashCtx_HandlerOrder(t *testing.T) {
+	captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	var order []string
+	handler := func(name string) func(interface{}) {
+		return func(interface{}) {
+			order = append(order, name)
+		}
+	}
+	PanicHandlers = append(PanicHandlers, handler("global"))
+	ctx := WithPanicHandlers(context.Background(), handler("request 1"))
+	ctx = WithPanicHandlers(ctx, handler("request 2"))
+	// Adding to a context doesn't affect the handlers of its parent.
+	WithPanicHandlers(ctx, handler("unused"))
+	func() {
+		defer HandleCrashCtx(ctx, handler("additional"))
+		panic("panicked")
+	}()
+	BlockingGoContext(ctx, func(ctx context.Context) {
+		if AttemptFromContext(ctx) == 1 {
+			panic("panicked")
+		}
+	}, WithOnPanic(func(PanicInfo) {
+		order = append(order, "on panic")
+	}))
+	expected := []string{"global", "request 1", "request 2", "additional", "global", "request 1", "request 2", "on panic"}
+	if strings.Join(order, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected handlers to run in order %q, got %q", expected, order)
+	}
+	if handlers := ContextPanicHandlers(context.Background()); handlers != nil {
+		t.Errorf("expected no handlers, got %d", len(handlers))
+	}
+}
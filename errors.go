@@ -0,0 +1,150 @@
+package reroutine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnhealthy is wrapped by the error Handle.WaitHealthy returns when
+// supervision ends before the worker became healthy.
+var ErrUnhealthy = errors.New("reroutine: supervision ended before the worker was healthy")
+
+// ErrStopped is the cause Handle.Cause returns when a go-routine was stopped
+// without a more specific cause, see Handle.StopCause, and the error reported
+// by supervisors stopped with WithStopIsError.
+var ErrStopped = errors.New("reroutine: stopped")
+
+// PanicError is an error describing a panic that a supervisor gave up on.
+type PanicError struct {
+	// Value is the value that was recovered.
+	Value interface{}
+	// Stack is the formatted stack trace of the panicking go-routine.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("reroutine: panic: %v", e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// MaxRestartsError is the error a supervisor gives up with when the worker
+// panics after exhausting the restarts allowed by WithMaxRestarts. It unwraps
+// to the *PanicError describing the last panic.
+type MaxRestartsError struct {
+	// Attempts is the number of times the worker was run.
+	Attempts int
+	// LastPanic is the value recovered from the last invocation.
+	LastPanic interface{}
+	// Stack is the formatted stack trace of the last panic.
+	Stack []byte
+}
+
+func (e *MaxRestartsError) Error() string {
+	return fmt.Sprintf("reroutine: gave up after %d attempts: panic: %v", e.Attempts, e.LastPanic)
+}
+
+// Unwrap returns the *PanicError describing the last panic.
+func (e *MaxRestartsError) Unwrap() error {
+	return &PanicError{Value: e.LastPanic, Stack: e.Stack}
+}
+
+// BudgetExceededError is the error a supervisor gives up with when the worker
+// panics after the retry budget configured with WithRetryBudget has elapsed. It
+// unwraps to the *PanicError describing the last panic.
+type BudgetExceededError struct {
+	// Budget is the configured retry budget.
+	Budget time.Duration
+	// Elapsed is how long the supervisor had been running when it gave up.
+	Elapsed time.Duration
+	// LastPanic is the value recovered from the last invocation.
+	LastPanic interface{}
+	// Stack is the formatted stack trace of the last panic.
+	Stack []byte
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("reroutine: retry budget of %v exceeded after %v: panic: %v", e.Budget, e.Elapsed, e.LastPanic)
+}
+
+// Unwrap returns the *PanicError describing the last panic.
+func (e *BudgetExceededError) Unwrap() error {
+	return &PanicError{Value: e.LastPanic, Stack: e.Stack}
+}
+
+// Backoff can be used as a panic value, or wrapped by an error used as a panic
+// value, to make the supervisor wait exactly Duration before the next restart
+// instead of the delay configured with WithBackoff. It allows a worker to pass
+// on a server-directed delay, such as a Retry-After header. A tomb worker can
+// also return it, or an error wrapping it, to be restarted in the same way
+// instead of ending supervision.
+type Backoff struct {
+	Duration time.Duration
+}
+
+func (b Backoff) Error() string {
+	return fmt.Sprintf("reroutine: retry after %v", b.Duration)
+}
+
+// Fatal can be used as a panic value, or wrapped by an error used as a panic
+// value, to declare that the worker can't recover from Err, so the supervisor
+// gives up instead of restarting it, with StopReasonFatal. The error the
+// supervisor gives up with unwraps to the Fatal, and Supervisor.Err returns
+// Err. The panic is still re-raised if ReallyCrash or WithReallyCrash is set.
+type Fatal struct {
+	Err error
+}
+
+func (f Fatal) Error() string {
+	return fmt.Sprintf("reroutine: fatal: %v", f.Err)
+}
+
+// Unwrap returns Err.
+func (f Fatal) Unwrap() error {
+	return f.Err
+}
+
+// fatal returns the Fatal carried by the recovered value r, if any.
+func fatal(r interface{}) (Fatal, bool) {
+	switch v := r.(type) {
+	case Fatal:
+		return v, true
+	case *Fatal:
+		if v == nil {
+			return Fatal{}, false
+		}
+		return *v, true
+	case error:
+		var f Fatal
+		if errors.As(v, &f) {
+			return f, true
+		}
+	}
+	return Fatal{}, false
+}
+
+// requestedBackoff returns the Backoff carried by the recovered value r, if any.
+func requestedBackoff(r interface{}) (Backoff, bool) {
+	switch v := r.(type) {
+	case Backoff:
+		return v, true
+	case *Backoff:
+		if v == nil {
+			return Backoff{}, false
+		}
+		return *v, true
+	case Result:
+		return Backoff{Duration: v.Delay}, v.Delay > 0
+	case error:
+		var b Backoff
+		if errors.As(v, &b) {
+			return b, true
+		}
+	}
+	return Backoff{}, false
+}
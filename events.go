@@ -0,0 +1,146 @@
+package reroutine
+
+import (
+	"sync"
+	"time"
+)
+
+// EventKind identifies what an Event describes.
+type EventKind int
+
+const (
+	// EventStart means an invocation of the worker has begun.
+	EventStart EventKind = iota
+	// EventPanic means a panic was recovered from the worker.
+	EventPanic
+	// EventStop means supervision has ended. It's the last event delivered.
+	EventStop
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStart:
+		return "start"
+	case EventPanic:
+		return "panic"
+	case EventStop:
+		return "stop"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something that happened to a supervised go-routine, as
+// delivered by Handle.Events.
+type Event struct {
+	Kind EventKind
+	// Attempt is the invocation the event is about. It's zero for EventStop.
+	Attempt int
+	// Goroutine is the id of the go-routine running the invocation for
+	// EventStart and EventPanic, for diagnostics only, see
+	// Supervisor.Goroutine. It's zero for EventStop.
+	Goroutine int64
+	// Reason is why supervision ended for EventStop, and why the supervisor
+	// is giving up for EventPanic, or StopReasonNone if it's restarting.
+	Reason StopReason
+	// Panic describes the panic for EventPanic. Its Stack is always nil, use
+	// Stack instead.
+	Panic *PanicInfo
+	// Time is when the event happened.
+	Time time.Time
+
+	stack *retainedStack
+}
+
+// Stack returns the stack trace of the panic for EventPanic. It returns nil if
+// the stack was dropped to honour SetMaxRetainedStackBytes.
+func (e Event) Stack() []byte {
+	if e.stack == nil {
+		return nil
+	}
+	return e.stack.get()
+}
+
+// panicEvent returns the EventPanic for info, the panic recovered from the
+// invocation identified by attempt, with the restart decision reason.
+func panicEvent(attempt int, reason StopReason, info PanicInfo) Event {
+	sig := info.Fingerprint
+	if sig == "" {
+		sig = fingerprint(info.Frames, 5)
+	}
+	stack := retainStack(info.Stack, sig)
+	info.Stack = nil
+	return Event{Kind: EventPanic, Attempt: attempt, Goroutine: info.Goroutine, Reason: reason, Panic: &info, Time: info.Time, stack: stack}
+}
+
+// EventDelivery controls what happens to events that are delivered while the
+// buffer configured with WithEvents is full.
+type EventDelivery int
+
+const (
+	// EventDropOldest discards the oldest buffered event to make room, so the
+	// consumer always sees the most recent events. It's the default.
+	EventDropOldest EventDelivery = iota
+	// EventDropNewest discards the event being delivered, so the consumer sees
+	// the events that filled the buffer first.
+	EventDropNewest
+	// EventBlock blocks the supervisor until the consumer has room for the
+	// event, so no event is ever lost. A consumer that stops reading stalls
+	// supervision, including restarts and stopping, so only use it when
+	// losing events is worse than that.
+	EventBlock
+)
+
+// events delivers the events of a supervisor to its channel.
+type events struct {
+	mode EventDelivery
+
+	m      sync.Mutex
+	c      chan Event
+	closed bool
+}
+
+// emit delivers e according to the delivery mode. Events emitted after close,
+// for example by an invocation left running after stop, are discarded.
+func (ev *events) emit(e Event) {
+	if ev == nil {
+		return
+	}
+	ev.m.Lock()
+	defer ev.m.Unlock()
+	if ev.closed {
+		return
+	}
+	switch ev.mode {
+	case EventBlock:
+		ev.c <- e
+	case EventDropNewest:
+		select {
+		case ev.c <- e:
+		default:
+		}
+	default:
+		for {
+			select {
+			case ev.c <- e:
+				return
+			default:
+			}
+			select {
+			case <-ev.c:
+			default:
+			}
+		}
+	}
+}
+
+// close closes the channel once the last event has been emitted.
+func (ev *events) close() {
+	if ev == nil {
+		return
+	}
+	ev.m.Lock()
+	defer ev.m.Unlock()
+	ev.closed = true
+	close(ev.c)
+}
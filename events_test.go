@@ -0,0 +1,156 @@
+package reroutine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func kinds(c <-chan Event) string {
+	var s string
+	for e := range c {
+		s += fmt.Sprintf("%v %d %v; ", e.Kind, e.Attempt, e.Reason)
+	}
+	return s
+}
+
+func TestHandle_Events(t *testing.T) {
+	captureLogs(t)
+	flapping := func() func() {
+		i := 0
+		return func() {
+			if i++; i < 3 {
+				panic("panicked")
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"Drop oldest", []Option{WithEvents(2)}, "start 3 none; stop 0 clean exit; "},
+		{"Drop newest", []Option{WithEvents(2), WithEventDelivery(EventDropNewest)}, "start 1 none; panic 1 none; "},
+	} {
+		h := Go(nil, flapping(), tt.opts...)
+		h.Wait()
+		if events := kinds(h.Events()); events != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, events)
+		}
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		h := Go(nil, flapping(), WithEvents(0), WithEventDelivery(EventBlock), WithMaxRestarts(1))
+		expected := "start 1 none; panic 1 none; start 2 none; panic 2 max restarts exceeded; stop 0 max restarts exceeded; "
+		if events := kinds(h.Events()); events != expected {
+			t.Errorf("expected %q, got %q", expected, events)
+		}
+		h.Wait()
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		h := Go(nil, func() {
+			panic("panicked")
+		}, WithEvents(8), WithMaxRestarts(1))
+		h.Wait()
+		<-h.Events()
+		if e := <-h.Events(); e.Kind != EventPanic || e.Panic == nil || e.Panic.Value != "panicked" || e.Stack() == nil {
+			t.Errorf("expected the panic event to describe the panic, got %+v", e)
+		}
+	})
+
+	h := Go(nil, func() {})
+	if h.Events() != nil {
+		t.Error("expected no events unless enabled")
+	}
+	h.Wait()
+}
+
+func TestWithEventWriter(t *testing.T) {
+	captureLogs(t)
+	var buf bytes.Buffer
+	Go(nil, func() {
+		panic("panicked")
+	}, WithEventWriter(&buf), WithName("worker"), WithMaxRestarts(1), WithBackoff(0, 0)).Wait()
+
+	var events string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e struct {
+			Time    string
+			Event   string
+			Name    string
+			Attempt int
+			Panic   string
+			Delay   string
+			Reason  string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("expected a JSON line, got %q: %v", scanner.Text(), err)
+		}
+		if e.Name != "worker" || e.Time == "" {
+			t.Errorf("expected the name and time, got %q", scanner.Text())
+		}
+		events += fmt.Sprintf("%s %d %s %s %s; ", e.Event, e.Attempt, e.Panic, e.Delay, e.Reason)
+	}
+	expected := "start 1   ; panic 1 panicked  ; restart 2  0s ; start 2   ; panic 2 panicked  max restarts exceeded; stop 0   max restarts exceeded; "
+	if events != expected {
+		t.Errorf("expected %q, got %q", expected, events)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("failed")
+}
+
+func TestWithEventWriter_Error(t *testing.T) {
+	captureLogs(t)
+	h := Go(nil, func() {
+		panic("panicked")
+	}, WithEventWriter(failingWriter{}), WithMaxRestarts(1), WithBackoff(0, 0))
+	h.Wait()
+	if h.Restarts() != 1 {
+		t.Errorf("expected supervision to ignore write errors, got %d restarts", h.Restarts())
+	}
+}
+
+func TestHandle_Goroutine(t *testing.T) {
+	captureLogs(t)
+	var m sync.Mutex
+	var ids []int64
+	var info PanicInfo
+	h := Go(nil, func() {
+		m.Lock()
+		ids = append(ids, currentGoroutineID())
+		first := len(ids) == 1
+		m.Unlock()
+		if first {
+			panic("panicked")
+		}
+	}, WithEvents(8), WithOnPanic(func(i PanicInfo) {
+		info = i
+	}))
+	var events []Event
+	for e := range h.Events() {
+		events = append(events, e)
+	}
+	h.Wait()
+	if len(ids) != 2 || ids[0] == 0 || ids[0] == ids[1] {
+		t.Fatalf("expected each invocation to run on its own go-routine, got %v", ids)
+	}
+	if len(events) != 4 || events[0].Goroutine != ids[0] || events[1].Goroutine != ids[0] || events[2].Goroutine != ids[1] || events[3].Goroutine != 0 {
+		t.Errorf("expected the events to carry the go-routine ids %v, got %+v", ids, events)
+	}
+	if info.Goroutine != ids[0] {
+		t.Errorf("expected the panic info to carry go-routine %d, got %d", ids[0], info.Goroutine)
+	}
+	if g := h.Goroutine(); g != ids[1] {
+		t.Errorf("expected the id of the last invocation's go-routine, got %d", g)
+	}
+}
@@ -0,0 +1,71 @@
+package reroutine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// eventWriterM serializes the writes of every supervisor's event writer, so
+// that supervisors sharing a writer never interleave their lines.
+var eventWriterM sync.Mutex
+
+// WithEventWriter writes the supervisor's events to w as newline-delimited
+// JSON, for structured logs without a logging library. Each line is an object
+// with the time, the event ("start", "panic", "restart" or "stop"), the name
+// configured with WithName and, where they apply, the attempt, the id of the
+// go-routine an invocation started on, the panic message, the delay before a
+// restart and the reason supervision ended or the supervisor is giving up.
+// Writes are serialized across all supervisors. Write errors are ignored, so
+// a failing writer never affects supervision.
+func WithEventWriter(w io.Writer) Option {
+	return func(o *options) {
+		o.eventWriter = w
+	}
+}
+
+type jsonEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Name      string    `json:"name,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Goroutine int64     `json:"goroutine,omitempty"`
+	Panic     string    `json:"panic,omitempty"`
+	Delay     string    `json:"delay,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// writeEvent writes e to the event writer, if any.
+func (s *Supervisor) writeEvent(e jsonEvent) {
+	if s.opts.eventWriter == nil {
+		return
+	}
+	e.Time = s.opts.clock.Now()
+	e.Name = s.opts.name
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	eventWriterM.Lock()
+	defer eventWriterM.Unlock()
+	s.opts.eventWriter.Write(append(b, '\n'))
+}
+
+// writePanicEvent writes the events for the panic r recovered from the
+// invocation identified by attempt, and for the restart after delay, or the
+// reason for not restarting.
+func (s *Supervisor) writePanicEvent(attempt int, r interface{}, delay time.Duration, reason StopReason) {
+	if s.opts.eventWriter == nil {
+		return
+	}
+	e := jsonEvent{Event: "panic", Attempt: attempt, Panic: fmt.Sprint(r)}
+	if reason != StopReasonNone {
+		e.Reason = reason.String()
+	}
+	s.writeEvent(e)
+	if reason == StopReasonNone {
+		s.writeEvent(jsonEvent{Event: "restart", Attempt: attempt + 1, Delay: delay.String()})
+	}
+}
@@ -0,0 +1,87 @@
+package reroutine
+
+import "sync"
+
+// Executor runs functions on go-routines that it manages, such as a worker
+// pool, allowing the number of go-routines created by supervisors to be
+// bounded.
+type Executor interface {
+	// Submit arranges for f to run on another go-routine. It may return before
+	// f has started, and f may be queued for any amount of time.
+	Submit(f func())
+}
+
+// ExecutorFunc adapts an ordinary function to the Executor interface.
+type ExecutorFunc func(f func())
+
+// Submit calls fn(f).
+func (fn ExecutorFunc) Submit(f func()) {
+	fn(f)
+}
+
+// goExecutor is the default Executor which starts a new go-routine for every
+// submitted function.
+type goExecutor struct{}
+
+func (goExecutor) Submit(f func()) {
+	spawn(f)
+}
+
+// NewBulkhead returns an Executor that submits functions to e but lets at most
+// k of them occupy e at the same time. Functions submitted beyond that wait in
+// the bulkhead, in the order they were submitted, until an earlier one
+// returns, so they don't take up slots or queue positions in e. Sharing a
+// bulkhead between the supervisors of a worker, for example the replicas of a
+// crash-looping consumer, stops their rapid restarts from monopolising a pool
+// shared with other workers. A k of less than one is treated as one.
+func NewBulkhead(e Executor, k int) Executor {
+	if k < 1 {
+		k = 1
+	}
+	return &bulkhead{e: e, k: k}
+}
+
+type bulkhead struct {
+	e Executor
+	k int
+
+	m       sync.Mutex
+	running int
+	queue   []func()
+}
+
+func (b *bulkhead) Submit(f func()) {
+	b.m.Lock()
+	if b.running >= b.k {
+		b.queue = append(b.queue, f)
+		b.m.Unlock()
+		return
+	}
+	b.running++
+	b.m.Unlock()
+	b.e.Submit(b.release(f))
+}
+
+// release wraps f so that the slot it occupies is handed to the next queued
+// function once it returns.
+func (b *bulkhead) release(f func()) func() {
+	return func() {
+		defer func() {
+			b.m.Lock()
+			if len(b.queue) == 0 {
+				b.running--
+				b.m.Unlock()
+				return
+			}
+			next := b.queue[0]
+			b.queue = b.queue[1:]
+			b.m.Unlock()
+			// Submit from a new go-routine, as e may block until one of its
+			// slots is free, and this function still occupies one.
+			spawn(func() {
+				b.e.Submit(b.release(next))
+			})
+		}()
+		f()
+	}
+}
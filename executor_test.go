@@ -0,0 +1,155 @@
+package reroutine
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// queueExecutor runs submitted functions one at a time on a single go-routine
+// after a short delay, like a saturated pool would.
+func queueExecutor() (Executor, func()) {
+	queue := make(chan func(), 16)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case f := <-queue:
+				time.Sleep(time.Millisecond)
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ExecutorFunc(func(f func()) {
+		queue <- f
+	}), func() { close(done) }
+}
+
+func TestExecutor(t *testing.T) {
+	t.Run("Restart", func(t *testing.T) {
+		e, closeExecutor := queueExecutor()
+		defer closeExecutor()
+		i := int32(0)
+		BlockingGo(make(chan struct{}), func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+		}, WithExecutor(e))
+		if atomic.LoadInt32(&i) != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+	t.Run("Stopped while queued", func(t *testing.T) {
+		queued := make(chan func(), 1)
+		e := ExecutorFunc(func(f func()) {
+			queued <- f
+		})
+		ran := int32(0)
+		h := Go(nil, func() {
+			atomic.StoreInt32(&ran, 1)
+		}, WithExecutor(e))
+		f := <-queued
+		h.Stop()
+		h.Wait()
+		f()
+		if atomic.LoadInt32(&ran) != 0 {
+			t.Error("expected queued invocation to be skipped after stop")
+		}
+	})
+}
+
+// poolExecutor runs submitted functions on n go-routines, like a fixed size
+// worker pool. Closing it waits for the running functions to return.
+func poolExecutor(n int) (Executor, func()) {
+	queue := make(chan func(), 64)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case f := <-queue:
+					f()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	return ExecutorFunc(func(f func()) {
+			queue <- f
+		}), func() {
+			close(done)
+			wg.Wait()
+		}
+}
+
+func TestBulkhead(t *testing.T) {
+	captureLogs(t)
+	before := ActiveGoroutines()
+	pool, closePool := poolExecutor(4)
+	stop := make(chan struct{})
+	bulkhead := NewBulkhead(pool, 1)
+	var flapping, maxFlapping, flaps int32
+	var handles []*Handle
+	for i := 0; i < 3; i++ {
+		handles = append(handles, Go(stop, func() {
+			n := atomic.AddInt32(&flapping, 1)
+			defer atomic.AddInt32(&flapping, -1)
+			for {
+				max := atomic.LoadInt32(&maxFlapping)
+				if n <= max || atomic.CompareAndSwapInt32(&maxFlapping, max, n) {
+					break
+				}
+			}
+			atomic.AddInt32(&flaps, 1)
+			time.Sleep(time.Millisecond)
+			panic("flapping")
+		}, WithExecutor(bulkhead)))
+	}
+	progress := make([]int32, 3)
+	for i := range progress {
+		i := i
+		handles = append(handles, Go(stop, func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				atomic.AddInt32(&progress[i], 1)
+				time.Sleep(time.Millisecond)
+			}
+		}, WithExecutor(pool)))
+	}
+	deadline := time.Now().Add(time.Second)
+	for i := range progress {
+		for atomic.LoadInt32(&progress[i]) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected healthy worker %d to make progress", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for atomic.LoadInt32(&flaps) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	for _, h := range handles {
+		h.Wait()
+	}
+	// Wait for the invocations left running, which may still log a panic, and
+	// for the bulkhead to stop resubmitting them.
+	closePool()
+	for deadline := time.Now().Add(time.Second); ActiveGoroutines() > before && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if max := atomic.LoadInt32(&maxFlapping); max != 1 {
+		t.Errorf("expected the flapping worker to hold at most one slot, got %d", max)
+	}
+}
@@ -0,0 +1,24 @@
+package reroutine
+
+import "sync/atomic"
+
+// activeGoroutines counts the go-routines started by spawn that are running.
+var activeGoroutines int64
+
+// ActiveGoroutines returns the number of go-routines started by the package
+// that are still running, including supervisors, workers run by the default
+// executor and internal helpers. Go-routines started by a custom Executor or
+// by a Tomb are owned by them and aren't counted. It's meant for monitoring
+// and for tests asserting that nothing leaks.
+func ActiveGoroutines() int {
+	return int(atomic.LoadInt64(&activeGoroutines))
+}
+
+// spawn runs f on a new go-routine counted by ActiveGoroutines.
+func spawn(f func()) {
+	atomic.AddInt64(&activeGoroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&activeGoroutines, -1)
+		f()
+	}()
+}
@@ -0,0 +1,34 @@
+package reroutine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveGoroutines(t *testing.T) {
+	captureLogs(t)
+	before := ActiveGoroutines()
+	stop := make(chan struct{})
+	release := make(chan struct{})
+	i := 0
+	h := Go(stop, func() {
+		if i++; i < 3 {
+			panic("panicked")
+		}
+		<-release
+	}, WithOnStable(time.Hour, func() {}))
+	<-h.Started()
+	if n := ActiveGoroutines(); n <= before {
+		t.Errorf("expected the supervisor's go-routines to be counted, got %d", n)
+	}
+	close(stop)
+	h.Wait()
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for ActiveGoroutines() != before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := ActiveGoroutines(); n != before {
+		t.Errorf("expected %d active go-routines once everything exited, got %d", before, n)
+	}
+}
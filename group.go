@@ -0,0 +1,148 @@
+package reroutine
+
+import (
+	"context"
+	"sync"
+)
+
+// Group supervises a set of go-routines that share the same options and are
+// stopped together.
+type Group struct {
+	opts   []Option
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m       sync.Mutex
+	members []*Handle
+}
+
+// NewGroup creates a group whose members are all supervised with opts. Options
+// that hold state, like WithRestartRate, are shared by every member.
+func NewGroup(opts ...Option) *Group {
+	return NewGroupContext(context.Background(), opts...)
+}
+
+// NewGroupContext is like NewGroup but the group is also stopped once ctx is
+// done, so a deadline on ctx stops every member. Members started with
+// GoContext receive a context derived from ctx, which carries its values and
+// deadline.
+func NewGroupContext(ctx context.Context, opts ...Option) *Group {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Go starts do as a member of the group. It behaves like Go, using the group's
+// stop channel and options, and returns the member's handle, which controls
+// the member on its own: stopping it, for example, doesn't stop the group.
+func (g *Group) Go(do func()) *Handle {
+	return g.GoCost(1, do)
+}
+
+// GoNamed is like Go but names the member, as WithName does, for example to
+// give it a priority with GroupWithRecoveryOrder.
+func (g *Group) GoNamed(name string, do func()) *Handle {
+	return g.goMember(do, WithName(name))
+}
+
+// GoCost is like Go but each restart of do debits cost tokens from the
+// group's restart rate limiter, so expensive members can be throttled harder
+// than cheap ones. See WithRestartCost.
+func (g *Group) GoCost(cost int, do func()) *Handle {
+	return g.goMember(do, WithRestartCost(cost))
+}
+
+// goMember starts do as a member of the group with opts on top of the group's
+// options.
+func (g *Group) goMember(do func(), opts ...Option) *Handle {
+	opts = append(append([]Option(nil), g.opts...), opts...)
+	s := NewSupervisor(do, opts...)
+	return g.add(start(g.ctx.Done(), s, s.Run))
+}
+
+// GoContext starts do as a member of the group. It behaves like GoContext,
+// using the group's context and options, so do observes the group being
+// stopped through its context, and returns the member's handle as Go does.
+func (g *Group) GoContext(do func(ctx context.Context)) *Handle {
+	s := newSupervisor(g.opts)
+	return g.add(start(g.ctx.Done(), s, func(stop <-chan struct{}) {
+		s.runContext(g.ctx, stop, do)
+	}))
+}
+
+// add records h as a member of the group, forgetting the members that have
+// finished so that a long-lived group doesn't accumulate them.
+func (g *Group) add(h *Handle) *Handle {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.pruneLocked()
+	g.members = append(g.members, h)
+	return h
+}
+
+// pruneLocked forgets the members that have finished. g.m must be held.
+func (g *Group) pruneLocked() {
+	live := g.members[:0]
+	for _, h := range g.members {
+		if !h.finished() {
+			live = append(live, h)
+		}
+	}
+	for i := len(live); i < len(g.members); i++ {
+		g.members[i] = nil
+	}
+	g.members = live
+}
+
+// Members returns the handles of the group's members, in the order they were
+// started. Members are forgotten once their supervision has ended and their
+// asynchronous work, such as the WithOnGiveUp callback and the delivery of
+// their events, has completed, so Members only returns those that are still
+// running or whose work is outstanding.
+func (g *Group) Members() []*Handle {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.pruneLocked()
+	return append([]*Handle(nil), g.members...)
+}
+
+// Stop stops supervising every member of the group. It is safe to call Stop
+// more than once.
+func (g *Group) Stop() {
+	g.cancel()
+}
+
+// Flush is like Handle.Flush for every member of the group, returning the
+// first error.
+func (g *Group) Flush(ctx context.Context) error {
+	for _, h := range g.Members() {
+		if err := h.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait blocks until the supervision of every member of the group has ended,
+// including members started while waiting.
+func (g *Group) Wait() {
+	for {
+		g.m.Lock()
+		g.pruneLocked()
+		var running *Handle
+		for _, h := range g.members {
+			if !h.ended() {
+				running = h
+				break
+			}
+		}
+		g.m.Unlock()
+		if running == nil {
+			return
+		}
+		running.Wait()
+	}
+}
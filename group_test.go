@@ -0,0 +1,223 @@
+package reroutine
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	t.Run("Stop", func(t *testing.T) {
+		g := NewGroup()
+		var started int32
+		for i := 0; i < 3; i++ {
+			g.Go(func() {
+				atomic.AddInt32(&started, 1)
+				select {}
+			})
+		}
+		for atomic.LoadInt32(&started) != 3 {
+			time.Sleep(time.Millisecond)
+		}
+		g.Stop()
+		g.Stop()
+		g.Wait()
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		g := NewGroupContext(ctx)
+		var drained int32
+		started := make(chan struct{})
+		g.GoContext(func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			atomic.AddInt32(&drained, 1)
+		})
+		g.Go(func() {
+			select {}
+		})
+		<-started
+		cancel()
+		g.Wait()
+		// The GoContext member is left running after being stopped, but it
+		// observes the cancellation and returns.
+		for atomic.LoadInt32(&drained) != 1 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		expected, _ := ctx.Deadline()
+		g := NewGroupContext(ctx)
+		var inherited, stopped int32
+		for i := 0; i < 3; i++ {
+			g.GoContext(func(ctx context.Context) {
+				if deadline, ok := ctx.Deadline(); ok && deadline.Equal(expected) {
+					atomic.AddInt32(&inherited, 1)
+				}
+				<-ctx.Done()
+				atomic.AddInt32(&stopped, 1)
+			})
+		}
+		g.Go(func() {
+			select {}
+		})
+		g.Wait()
+		if late := time.Since(expected); late < 0 || late > time.Second {
+			t.Errorf("expected the group to stop at its deadline, stopped %v after", late)
+		}
+		for atomic.LoadInt32(&stopped) != atomic.LoadInt32(&inherited) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&inherited); n != 3 {
+			t.Errorf("expected every member to inherit the deadline, got %d", n)
+		}
+	})
+
+	t.Run("Restart cost", func(t *testing.T) {
+		// The bucket holds a single token that refills every 50ms, so a member
+		// costing four tokens per restart has to wait roughly 150ms to restart.
+		g := NewGroup(WithRestartRate(20, 1))
+		var i int32
+		start := time.Now()
+		g.GoCost(4, func() {
+			if atomic.AddInt32(&i, 1) == 1 {
+				panic("panicked")
+			}
+		})
+		g.Wait()
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("expected restart to be throttled, took %v", elapsed)
+		}
+	})
+}
+
+func TestGroup_Members(t *testing.T) {
+	captureLogs(t)
+	g := NewGroup(WithBackoff(0, 0))
+	stop := make(chan struct{})
+	i := 0
+	flapping := g.GoNamed("flapping", func() {
+		if i++; i < 3 {
+			panic("panicked")
+		}
+		<-stop
+	})
+	other := g.Go(func() {
+		<-stop
+	})
+	ctxMember := g.GoContext(func(ctx context.Context) {
+		<-ctx.Done()
+	})
+	if members := g.Members(); len(members) != 3 || members[0] != flapping || members[1] != other || members[2] != ctxMember {
+		t.Fatalf("expected the members' handles in order, got %v", members)
+	}
+
+	ctxMember.Stop()
+	ctxMember.Wait()
+	if ctxMember.Reason() != StopReasonStopped || other.Reason() != StopReasonNone {
+		t.Errorf("expected only the stopped member to end, got %v and %v", ctxMember.Reason(), other.Reason())
+	}
+	deadline := time.Now().Add(time.Second)
+	for flapping.Restarts() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if flapping.Restarts() != 2 || other.Restarts() != 0 {
+		t.Errorf("expected the members' own restarts, got %d and %d", flapping.Restarts(), other.Restarts())
+	}
+	close(stop)
+	g.Stop()
+	g.Wait()
+}
+
+func TestGroup_ForgetsFinishedMembers(t *testing.T) {
+	g := NewGroup()
+	stop := make(chan struct{})
+	running := g.Go(func() {
+		<-stop
+	})
+	for i := 0; i < 100; i++ {
+		g.Go(func() {}).Wait()
+	}
+	if members := g.Members(); len(members) != 1 || members[0] != running {
+		t.Errorf("expected only the running member to be kept, got %d members", len(members))
+	}
+	g.m.Lock()
+	n := len(g.members)
+	g.m.Unlock()
+	if n > 2 {
+		t.Errorf("expected finished members to be forgotten as others start, got %d", n)
+	}
+	close(stop)
+	g.Wait()
+	if members := g.Members(); len(members) != 0 {
+		t.Errorf("expected every member to be forgotten, got %d", len(members))
+	}
+}
+
+func TestGroup_Flush(t *testing.T) {
+	captureLogs(t)
+	release := make(chan struct{})
+	var called int32
+	g := NewGroup(WithMaxRestarts(1), WithOnGiveUp(func(context.Context, StopReason, error) {
+		<-release
+		atomic.AddInt32(&called, 1)
+	}))
+	g.Go(func() {
+		panic("panicked")
+	})
+	g.GoContext(func(context.Context) {})
+	g.Wait()
+	if err := g.Flush(timeout(t, 10*time.Millisecond)); err == nil {
+		t.Error("expected the callback to be outstanding")
+	}
+	close(release)
+	if err := g.Flush(context.Background()); err != nil || atomic.LoadInt32(&called) != 1 {
+		t.Errorf("expected the callback to have completed, got %v", err)
+	}
+}
+
+func TestGroupWithRecoveryOrder(t *testing.T) {
+	captureLogs(t)
+	priorities := map[string]int{"low": 1, "critical": 3, "normal": 2}
+	order := GroupWithRecoveryOrder(func(name string) int {
+		return priorities[name]
+	}, 1)
+	gate := newOptions([]Option{order}).recovery
+	// Hold the only slot so that every member has to queue for it.
+	gate.acquire(context.Background(), 0)
+	g := NewGroup(order)
+	restarted := make(chan string, len(priorities))
+	for name := range priorities {
+		name := name
+		var i int32
+		g.GoNamed(name, func() {
+			if atomic.AddInt32(&i, 1) == 1 {
+				panic("panicked")
+			}
+			restarted <- name
+			<-g.ctx.Done()
+		})
+	}
+	for {
+		gate.m.Lock()
+		waiting := len(gate.waiters)
+		gate.m.Unlock()
+		if waiting == len(priorities) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	gate.release()
+	for _, expected := range []string{"critical", "normal", "low"} {
+		if name := <-restarted; name != expected {
+			t.Errorf("expected %s to restart next, got %s", expected, name)
+		}
+	}
+	g.Stop()
+	g.Wait()
+}
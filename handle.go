@@ -0,0 +1,331 @@
+package reroutine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Handle controls a supervised go-routine started with one of the non-blocking
+// Go functions.
+type Handle struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	cause    error // why the handle was stopped, see StopCause
+	done     chan struct{}
+
+	m        sync.Mutex
+	s        *Supervisor   // the supervisor of the active worker
+	fallback bool          // whether the active worker is a fallback
+	switched chan struct{} // closed when a fallback takes over
+}
+
+// start runs fn on a new go-routine and returns a handle for the supervisor s
+// whose Wait blocks until fn returns. fn must return once the handle's stop
+// channel is closed. Closing stopChan stops the handle as well.
+func start(stopChan <-chan struct{}, s *Supervisor, fn func(stop <-chan struct{})) *Handle {
+	h := &Handle{
+		s:    s,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if s.opts.fallback != nil {
+		// Left nil otherwise, as a nil channel is never closed.
+		h.switched = make(chan struct{})
+	}
+	// Registered before returning, rather than only once fn starts
+	// supervising, so that WaitAll can't miss a go-routine that was just
+	// started.
+	register(s)
+	if stopChan != nil {
+		spawn(func() {
+			select {
+			case <-stopChan:
+				h.Stop()
+			case <-h.done:
+			}
+		})
+	}
+	spawn(func() {
+		defer close(h.done)
+		fn(h.stop)
+		h.runFallbacks()
+	})
+	return h
+}
+
+// ended reports whether supervision of the go-routine has ended.
+func (h *Handle) ended() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finished reports whether supervision of the go-routine has ended and the
+// asynchronous work of its supervisor, which Flush waits for, has completed.
+func (h *Handle) finished() bool {
+	if !h.ended() {
+		return false
+	}
+	s := h.supervisor()
+	s.m.Lock()
+	callbacks := s.pendingCallbacks
+	s.m.Unlock()
+	return callbacks == 0 && s.notified.fired() && (s.events == nil || len(s.events.c) == 0)
+}
+
+// runFallbacks supervises the fallback configured with WithFallback, if any,
+// once the active worker's supervisor has given up, and so on for the
+// fallback's own fallback.
+func (h *Handle) runFallbacks() {
+	for {
+		s := h.supervisor()
+		if s.opts.fallback == nil || !gaveUp(s.Reason()) {
+			return
+		}
+		select {
+		case <-h.stop:
+			return
+		default:
+		}
+		fallback := NewSupervisor(s.opts.fallback, s.opts.fallbackOpts...)
+		h.m.Lock()
+		h.s = fallback
+		h.fallback = true
+		close(h.switched)
+		h.switched = make(chan struct{})
+		h.m.Unlock()
+		fallback.Run(h.stop)
+	}
+}
+
+// gaveUp reports whether supervision ending for reason means the supervisor
+// gave up, rather than the worker returning or being stopped. Re-raised panics
+// aren't included, as they don't end supervision gracefully.
+func gaveUp(reason StopReason) bool {
+	switch reason {
+	case StopReasonNone, StopReasonClean, StopReasonStopped, StopReasonCrash:
+		return false
+	default:
+		return true
+	}
+}
+
+// supervisor returns the supervisor of the active worker.
+func (h *Handle) supervisor() *Supervisor {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.s
+}
+
+// UsingFallback reports whether the active worker is the fallback configured
+// with WithFallback, rather than the primary worker.
+func (h *Handle) UsingFallback() bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.fallback
+}
+
+// Stop stops restarting the go-routine. It does not wait for supervision to
+// end, use Wait for that. It is safe to call Stop more than once.
+func (h *Handle) Stop() {
+	h.StopCause(nil)
+}
+
+// StopCause is like Stop but records cause as the reason the go-routine was
+// stopped, which Cause then returns, so that the different paths that can stop
+// a worker can be told apart. A nil cause is recorded as ErrStopped. Only the
+// first call to Stop or StopCause has an effect.
+func (h *Handle) StopCause(cause error) {
+	if cause == nil {
+		cause = ErrStopped
+	}
+	h.stopOnce.Do(func() {
+		h.m.Lock()
+		h.cause = cause
+		h.m.Unlock()
+		close(h.stop)
+	})
+}
+
+// Cause returns the cause passed to StopCause if supervision ended because the
+// go-routine was stopped, or ErrStopped if it was stopped by Stop or by closing
+// its stop channel. It returns nil while supervision is ongoing or if it ended
+// for any other reason, such as the worker returning.
+func (h *Handle) Cause() error {
+	if h.Reason() != StopReasonStopped {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.cause
+}
+
+// Wait blocks until supervision of the go-routine has ended, including running
+// the finalizer configured with WithFinalizer.
+func (h *Handle) Wait() {
+	<-h.done
+}
+
+// WaitContext is like Wait but gives up waiting once ctx is done, returning
+// ctx.Err(). Giving up waiting does not stop the go-routine.
+func (h *Handle) WaitContext(ctx context.Context) error {
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush blocks until the asynchronous work of the go-routine's supervisor that
+// is under way has completed, or ctx is done. See Supervisor.Flush.
+func (h *Handle) Flush(ctx context.Context) error {
+	return h.supervisor().Flush(ctx)
+}
+
+// WaitGiveUpCallback blocks until supervision has ended and the callback
+// configured with WithOnGiveUp, if it was called, has returned, or until ctx
+// is done, in which case it returns ctx.Err().
+func (h *Handle) WaitGiveUpCallback(ctx context.Context) error {
+	return h.supervisor().WaitGiveUpCallback(ctx)
+}
+
+// WaitHealthy blocks until an invocation of the worker has returned without
+// panicking or, if a stability window was configured with WithStabilityWindow
+// or WithOnStable, has run for that long without panicking. It returns an
+// error wrapping ErrUnhealthy if supervision ends first, for example because
+// the supervisor gave up, or ctx.Err() if ctx is done first. Without a
+// stability window, a worker that never returns is never considered healthy.
+func (h *Handle) WaitHealthy(ctx context.Context) error {
+	for {
+		h.m.Lock()
+		s, switched := h.s, h.switched
+		h.m.Unlock()
+		select {
+		case <-s.healthy.wait():
+			return nil
+		case <-switched:
+			// A fallback took over, so wait for it instead.
+		case <-h.done:
+			select {
+			case <-s.healthy.wait():
+				return nil
+			default:
+				return fmt.Errorf("%w: %v", ErrUnhealthy, s.Reason())
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Started returns a channel that is closed once the first invocation of the
+// worker has begun. It is closed exactly once and is not affected by restarts.
+// If supervision ends before the worker was ever invoked, it is never closed.
+func (h *Handle) Started() <-chan struct{} {
+	return h.supervisor().Started()
+}
+
+// Reason returns why supervision of the go-routine ended, or StopReasonNone if
+// it hasn't ended yet.
+func (h *Handle) Reason() StopReason {
+	select {
+	case <-h.done:
+		return h.supervisor().Reason()
+	default:
+		return StopReasonNone
+	}
+}
+
+// Fingerprints returns the number of panics recovered so far for each distinct
+// crash fingerprint. It is empty unless fingerprinting is enabled with
+// WithFingerprint. The returned map is a copy and safe to modify.
+func (h *Handle) Fingerprints() map[string]int {
+	return h.supervisor().Fingerprints()
+}
+
+// SetWorker replaces the supervised function with do from the next restart
+// on. See Supervisor.SetWorker.
+func (h *Handle) SetWorker(do func()) {
+	h.supervisor().SetWorker(do)
+}
+
+// Err returns the error of the Result returned by the last invocation of a
+// worker supervised with GoResult, or the error carried by the Fatal panic
+// the supervisor gave up on, if any, or ErrStopped once supervision was
+// stopped with WithStopIsError.
+func (h *Handle) Err() error {
+	return h.supervisor().Err()
+}
+
+// PanicRate returns the number of panics per second over the trailing window.
+// See Supervisor.PanicRate.
+func (h *Handle) PanicRate(window time.Duration) float64 {
+	return h.supervisor().PanicRate(window)
+}
+
+// Goroutine returns the id of the go-routine running the current or last
+// invocation of the worker. See Supervisor.Goroutine.
+func (h *Handle) Goroutine() int64 {
+	return h.supervisor().Goroutine()
+}
+
+// Restarts returns the number of times the go-routine has been restarted so
+// far.
+func (h *Handle) Restarts() int {
+	return h.supervisor().Restarts()
+}
+
+// Events returns the channel on which the go-routine's events are delivered,
+// which is closed once supervision has ended. It returns nil unless WithEvents
+// is set.
+func (h *Handle) Events() <-chan Event {
+	return h.supervisor().Events()
+}
+
+// Stats returns a consistent snapshot of the go-routine's counters.
+func (h *Handle) Stats() Stats {
+	return h.supervisor().Stats()
+}
+
+// NextRestart returns when the go-routine will be restarted while its
+// supervisor is backing off, and false otherwise. See Supervisor.NextRestart.
+func (h *Handle) NextRestart() (at time.Time, ok bool) {
+	return h.supervisor().NextRestart()
+}
+
+// InjectPanic makes the go-routine panic with v, for chaos testing. See
+// Supervisor.InjectPanic.
+func (h *Handle) InjectPanic(v interface{}) error {
+	return h.supervisor().InjectPanic(v)
+}
+
+// SetVerbose turns verbose panic logging on or off for the go-routine. See
+// Supervisor.SetVerbose.
+func (h *Handle) SetVerbose(verbose bool) {
+	h.supervisor().SetVerbose(verbose)
+}
+
+// TriggeredRestarts returns the number of times the go-routine has been
+// restarted by WithRestartTrigger so far.
+func (h *Handle) TriggeredRestarts() int {
+	return h.supervisor().TriggeredRestarts()
+}
+
+// FinalPanic returns the recovered value of the panic that the supervisor gave
+// up on, for example because the restarts were exhausted. It returns nil while
+// supervision is ongoing and when it ended for any other reason, such as a
+// clean exit or being stopped.
+func (h *Handle) FinalPanic() interface{} {
+	select {
+	case <-h.done:
+		return h.supervisor().FinalPanic()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,464 @@
+package reroutine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	t.Run("Stop", func(t *testing.T) {
+		started := make(chan struct{})
+		h := Go(nil, func() {
+			close(started)
+			select {}
+		})
+		<-started
+		h.Stop()
+		h.Stop()
+		h.Wait()
+	})
+	t.Run("Stop cause", func(t *testing.T) {
+		cause := errors.New("operator kick")
+		started := make(chan struct{})
+		h := Go(nil, func() {
+			close(started)
+			select {}
+		})
+		if err := h.Cause(); err != nil {
+			t.Errorf("expected no cause while running, got %v", err)
+		}
+		<-started
+		h.StopCause(cause)
+		h.StopCause(errors.New("ignored"))
+		h.Wait()
+		if err := h.Cause(); err != cause {
+			t.Errorf("expected %v, got %v", cause, err)
+		}
+
+		h = Go(nil, func() {
+			select {}
+		})
+		h.Stop()
+		h.Wait()
+		if err := h.Cause(); err != ErrStopped {
+			t.Errorf("expected %v, got %v", ErrStopped, err)
+		}
+
+		h = Go(nil, func() {})
+		h.Wait()
+		h.StopCause(cause)
+		if err := h.Cause(); err != nil {
+			t.Errorf("expected no cause after a clean exit, got %v", err)
+		}
+	})
+	t.Run("Stop channel", func(t *testing.T) {
+		stop := make(chan struct{})
+		h := Go(stop, func() {
+			select {}
+		})
+		close(stop)
+		h.Wait()
+	})
+	t.Run("Finalizer", func(t *testing.T) {
+		var finalized int32
+		stop := make(chan struct{})
+		h := Go(stop, func() {
+			<-stop
+		}, WithFinalizer(func() {
+			atomic.AddInt32(&finalized, 1)
+		}))
+		close(stop)
+		h.Wait()
+		if atomic.LoadInt32(&finalized) != 1 {
+			t.Error("expected finalizer to run once before Wait returned")
+		}
+	})
+	t.Run("Finalizer panic", func(t *testing.T) {
+		logs := captureLogs(t)
+		h := Go(nil, func() {}, WithFinalizer(func() {
+			panic("panicked")
+		}))
+		h.Wait()
+		if lines := logs(); len(lines) != 1 {
+			t.Errorf("expected finalizer panic to be logged, got %v", lines)
+		}
+	})
+	t.Run("Finalizer panic with ReallyCrash", func(t *testing.T) {
+		captureLogs(t)
+		defer func(v bool) { ReallyCrash = v }(ReallyCrash)
+		ReallyCrash = true
+		BlockingGo(nil, func() {}, WithFinalizer(func() {
+			panic("panicked")
+		}))
+	})
+	t.Run("Finalizer after inline worker", func(t *testing.T) {
+		var running int32
+		release := make(chan struct{})
+		h := Go(nil, func() {
+			atomic.StoreInt32(&running, 1)
+			<-release
+			atomic.StoreInt32(&running, 0)
+		}, WithInline(), WithFinalizer(func() {
+			if atomic.LoadInt32(&running) != 0 {
+				t.Error("expected finalizer to run after the worker returned")
+			}
+		}))
+		h.Stop()
+		close(release)
+		h.Wait()
+	})
+	t.Run("Clean exit", func(t *testing.T) {
+		var exits int32
+		onCleanExit := WithOnCleanExit(func() {
+			atomic.AddInt32(&exits, 1)
+		})
+		Go(nil, func() {}, onCleanExit).Wait()
+		Go(nil, func() { panic("panicked") }, onCleanExit, WithMaxRestarts(1)).Wait()
+		if atomic.LoadInt32(&exits) != 1 {
+			t.Errorf("expected one clean exit, got %d", exits)
+		}
+	})
+	t.Run("Wait context", func(t *testing.T) {
+		release := make(chan struct{})
+		h := Go(nil, func() {
+			<-release
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := h.WaitContext(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		if h.Reason() != StopReasonNone {
+			t.Error("expected abandoning the wait to leave the go-routine running")
+		}
+		close(release)
+		if err := h.WaitContext(context.Background()); err != nil {
+			t.Errorf("expected nil, got %v", err)
+		}
+	})
+	t.Run("Inline", func(t *testing.T) {
+		var i int32
+		h := GoInline(nil, func() {
+			atomic.AddInt32(&i, 1)
+		})
+		if atomic.LoadInt32(&i) != 1 {
+			t.Error("expected first invocation to run before GoInline returned")
+		}
+		h.Wait()
+		if h.Reason() != StopReasonClean {
+			t.Errorf("expected clean exit, got %v", h.Reason())
+		}
+	})
+	t.Run("Inline restart", func(t *testing.T) {
+		var i int32
+		h := GoInline(nil, func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+		})
+		h.Wait()
+		if atomic.LoadInt32(&i) != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+	t.Run("Inline like restarts", func(t *testing.T) {
+		captureLogs(t)
+		var i, wrapped int32
+		h := GoInline(nil, func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+		}, WithGoroutineWrapper(func(f func()) func() {
+			atomic.AddInt32(&wrapped, 1)
+			return f
+		}))
+		h.Wait()
+		if atomic.LoadInt32(&wrapped) != 3 {
+			t.Errorf("expected every invocation to be wrapped, including the first, got %d", wrapped)
+		}
+
+		flight := WithSingleFlight()
+		release := make(chan struct{})
+		running := Go(nil, func() {
+			<-release
+		}, flight)
+		<-running.Started()
+		stop := make(chan struct{})
+		close(stop)
+		var ran int32
+		h = GoInline(stop, func() {
+			atomic.AddInt32(&ran, 1)
+		}, flight)
+		h.Wait()
+		if atomic.LoadInt32(&ran) != 0 || h.Reason() != StopReasonStopped {
+			t.Errorf("expected the first invocation to wait for the flight until stopped, got %d runs (%v)", ran, h.Reason())
+		}
+		close(release)
+		running.Wait()
+	})
+	t.Run("Started", func(t *testing.T) {
+		release := make(chan struct{})
+		var i int32
+		h := Go(nil, func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+			<-release
+		})
+		<-h.Started()
+		<-h.Started()
+		close(release)
+		h.Wait()
+	})
+	t.Run("Not started", func(t *testing.T) {
+		queued := make(chan func(), 1)
+		h := Go(nil, func() {}, WithExecutor(ExecutorFunc(func(f func()) {
+			queued <- f
+		})))
+		<-queued
+		h.Stop()
+		h.Wait()
+		select {
+		case <-h.Started():
+			t.Error("expected Started not to be closed")
+		default:
+		}
+	})
+}
+
+func TestHandle_WaitHealthy(t *testing.T) {
+	captureLogs(t)
+	t.Run("Clean", func(t *testing.T) {
+		var i int32
+		h := Go(nil, func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+		})
+		if err := h.WaitHealthy(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("Stable", func(t *testing.T) {
+		clock := newFakeClock()
+		h := Go(nil, func() {
+			select {}
+		}, WithClock(clock), WithStabilityWindow(time.Minute))
+		defer h.Stop()
+		if err := h.WaitHealthy(timeout(t, 10*time.Millisecond)); err != context.DeadlineExceeded {
+			t.Errorf("expected not to be healthy yet, got %v", err)
+		}
+		<-clock.added
+		clock.Advance(time.Minute)
+		if err := h.WaitHealthy(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("Give up", func(t *testing.T) {
+		h := Go(nil, func() {
+			panic("panicked")
+		}, WithMaxRestarts(1))
+		if err := h.WaitHealthy(context.Background()); !errors.Is(err, ErrUnhealthy) {
+			t.Errorf("expected to be unhealthy, got %v", err)
+		}
+	})
+}
+
+func TestHandle_SetWorker(t *testing.T) {
+	captureLogs(t)
+	release := make(chan struct{})
+	var old, replacement int32
+	h := Go(nil, func() {
+		atomic.AddInt32(&old, 1)
+		<-release
+		panic("panicked")
+	})
+	<-h.Started()
+	h.SetWorker(func() {
+		atomic.AddInt32(&replacement, 1)
+	})
+	close(release)
+	h.Wait()
+	if atomic.LoadInt32(&old) != 1 || atomic.LoadInt32(&replacement) != 1 || h.Reason() != StopReasonClean {
+		t.Errorf("expected the replacement to take over after the restart, got %d old and %d new invocations (%v)", old, replacement, h.Reason())
+	}
+}
+
+func TestHandle_WaitGiveUpCallback(t *testing.T) {
+	captureLogs(t)
+	release := make(chan struct{})
+	var reason StopReason
+	var err error
+	var attempt int
+	h := Go(nil, func() {
+		panic("panicked")
+	}, WithMaxRestarts(1), WithOnGiveUp(func(ctx context.Context, r StopReason, e error) {
+		<-release
+		reason, err, attempt = r, e, AttemptFromContext(ctx)
+	}))
+	h.Wait()
+	if err := h.WaitGiveUpCallback(timeout(t, 10*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Errorf("expected supervision to end without waiting for the callback, got %v", err)
+	}
+	close(release)
+	if err := h.WaitGiveUpCallback(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var maxRestarts *MaxRestartsError
+	if reason != StopReasonMaxRestarts || !errors.As(err, &maxRestarts) || attempt != 2 {
+		t.Errorf("expected the callback to receive the give up, got %v, %v on attempt %d", reason, err, attempt)
+	}
+
+	h = Go(nil, func() {}, WithOnGiveUp(func(context.Context, StopReason, error) {
+		t.Error("expected the callback not to be called on a clean exit")
+	}))
+	if err := h.WaitGiveUpCallback(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandle_Stats(t *testing.T) {
+	captureLogs(t)
+	var i int32
+	h := Go(nil, func() {
+		if atomic.AddInt32(&i, 1) < 3 {
+			panic("panicked")
+		}
+	})
+	h.Wait()
+	expected := Stats{Starts: 3, Panics: 2, Restarts: 2, CleanStops: 1}
+	if stats := h.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	h = Go(nil, func() {
+		panic("panicked")
+	}, WithMaxRestarts(1))
+	h.Wait()
+	expected = Stats{Starts: 2, Panics: 2, Restarts: 1, GiveUps: 1}
+	if stats := h.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+func TestHandle_Flush(t *testing.T) {
+	captureLogs(t)
+	release := make(chan struct{})
+	h := Go(nil, func() {
+		panic("panicked")
+	}, WithMaxRestarts(1), WithEvents(8), WithOnGiveUp(func(context.Context, StopReason, error) {
+		<-release
+	}))
+	h.Wait()
+	if err := h.Flush(timeout(t, 10*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the callback and events to be outstanding, got %v", err)
+	}
+	close(release)
+	if err := h.Flush(timeout(t, 10*time.Millisecond)); err == nil {
+		t.Error("expected the unread events to be outstanding")
+	}
+	for range h.Events() {
+	}
+	if err := h.Flush(timeout(t, time.Second)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandle_Fallback(t *testing.T) {
+	captureLogs(t)
+	var primary, fallback int32
+	release := make(chan struct{})
+	degraded := make(chan struct{})
+	h := Go(nil, func() {
+		atomic.AddInt32(&primary, 1)
+		<-release
+		panic("panicked")
+	}, WithMaxRestarts(1), WithFallback(func() {
+		if atomic.AddInt32(&fallback, 1) == 1 {
+			close(degraded)
+			panic("panicked")
+		}
+		select {}
+	}))
+	if h.UsingFallback() {
+		t.Error("expected the primary to be active first")
+	}
+	close(release)
+	<-degraded
+	if err := h.WaitHealthy(timeout(t, 10*time.Millisecond)); err != context.DeadlineExceeded {
+		t.Errorf("expected the fallback not to be healthy yet, got %v", err)
+	}
+	for atomic.LoadInt32(&fallback) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if !h.UsingFallback() || h.Restarts() != 1 || atomic.LoadInt32(&primary) != 2 {
+		t.Errorf("expected the fallback to take over with its own restarts, got %d", h.Restarts())
+	}
+	h.Stop()
+	h.Wait()
+	if h.Reason() != StopReasonStopped {
+		t.Errorf("expected stopping to stop the fallback, got %v", h.Reason())
+	}
+}
+
+func TestHandle_NextRestart(t *testing.T) {
+	captureLogs(t)
+	clock := newFakeClock()
+	start := clock.Now()
+	var i int32
+	h := Go(nil, func() {
+		if atomic.AddInt32(&i, 1) == 1 {
+			panic("panicked")
+		}
+		select {}
+	}, WithClock(clock), WithBackoff(12*time.Second, 0))
+	<-clock.added
+	if at, ok := h.NextRestart(); !ok || !at.Equal(start.Add(12*time.Second)) {
+		t.Errorf("expected the restart to be scheduled in 12s, got %v, %v", at, ok)
+	}
+	h.Stop()
+	h.Wait()
+	if _, ok := h.NextRestart(); ok {
+		t.Error("expected stopping to cancel the scheduled restart")
+	}
+}
+
+type backoffMetrics struct {
+	m     sync.Mutex
+	names []string
+	total time.Duration
+}
+
+func (b *backoffMetrics) AddBackoff(name string, d time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.names = append(b.names, name)
+	b.total += d
+}
+
+func TestHandle_BackoffTime(t *testing.T) {
+	captureLogs(t)
+	clock := newFakeClock()
+	metrics := &backoffMetrics{}
+	h := Go(nil, func() {
+		panic("panicked")
+	}, WithClock(clock), WithBackoff(10*time.Second, 10*time.Second), WithName("worker"), WithMetrics(metrics))
+	<-clock.added
+	clock.Advance(10 * time.Second)
+	<-clock.added
+	clock.Advance(3 * time.Second)
+	h.Stop()
+	h.Wait()
+	if stats := h.Stats(); stats.BackoffTime != 13*time.Second {
+		t.Errorf("expected 13s of backoff, including the one cut short, got %v", stats.BackoffTime)
+	}
+	metrics.m.Lock()
+	defer metrics.m.Unlock()
+	if metrics.total != 13*time.Second || len(metrics.names) != 2 || metrics.names[0] != "worker" {
+		t.Errorf("expected two backoffs of worker totalling 13s, got %v, %v", metrics.names, metrics.total)
+	}
+}
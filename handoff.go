@@ -0,0 +1,250 @@
+package reroutine
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// HandoffHandle controls a go-routine started with GoHandoff. Besides the
+// methods of Handle, it can hand the work over to a new invocation of the
+// worker without a gap, see Handoff.
+type HandoffHandle struct {
+	*Handle
+
+	handoffM sync.Mutex // held while a handoff is in progress
+
+	m       sync.Mutex
+	worker  func(ready func(), stop <-chan struct{})
+	current *handoffInvocation // the invocation doing the work, if any
+	live    map[*handoffInvocation]struct{}
+	stopped bool
+}
+
+// handoffInvocation is a single invocation of a worker started with
+// GoHandoff. All fields but the channels are guarded by HandoffHandle.m.
+type handoffInvocation struct {
+	stop      chan struct{}
+	stopOnce  sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+	done      chan struct{} // closed once an invocation run by Handoff returns
+
+	ended    bool               // whether the worker has returned or panicked
+	next     *handoffInvocation // the invocation the work was handed off to
+	panicked bool
+	value    interface{} // the recovered value, if panicked
+	stack    []byte
+}
+
+func (inv *handoffInvocation) markReady() {
+	inv.readyOnce.Do(func() {
+		close(inv.ready)
+	})
+}
+
+func (inv *handoffInvocation) close() {
+	inv.stopOnce.Do(func() {
+		close(inv.stop)
+	})
+}
+
+// GoHandoff is like GoDrain for a worker whose invocations can be replaced
+// without a gap, for example one serving traffic. do is passed ready, which it
+// calls once it's ready to do the work, and stop, which is closed when the
+// invocation should return: once the work has been handed off to a new
+// invocation with HandoffHandle.Handoff, or once the stop channel is closed
+// or Handle.Stop is called. Panics are restarted as usual, without waiting
+// for the restarted invocation to be ready.
+func GoHandoff(stopChan <-chan struct{}, do func(ready func(), stop <-chan struct{}), opts ...Option) *HandoffHandle {
+	h := &HandoffHandle{
+		worker: do,
+		live:   make(map[*handoffInvocation]struct{}),
+	}
+	s := newSupervisor(opts)
+	h.Handle = start(stopChan, s, func(stop <-chan struct{}) {
+		s.run(stop, func(int) {
+			h.supervise()
+		})
+	})
+	spawn(func() {
+		select {
+		case <-h.Handle.stop:
+			h.stopAll()
+		case <-h.Handle.done:
+		}
+	})
+	return h
+}
+
+// Handoff hands the work over to a new invocation of the worker, or of do if
+// it isn't nil, in which case do replaces the worker for every later
+// invocation too. The new invocation is started alongside the running one,
+// and only once it has called ready is the running invocation's stop channel
+// closed, so the two deliberately overlap for as long as the running
+// invocation takes to return, even with WithSingleFlight. From then on the
+// new invocation is supervised in place of the old one: if it panics, it's
+// restarted as usual, although the stack trace of the panic is that of the
+// supervising go-routine re-raising it, and a panic in the old invocation
+// while it returns is only passed to the PanicHandlers.
+//
+// Handoff returns an error if no invocation is running, for example while the
+// supervisor backs off. It also returns an error, and the running invocation
+// carries on, if the new invocation panics or returns before it's ready, if
+// the running invocation ends first, or if ctx is done first, in which case
+// the new invocation is stopped. Only one handoff runs at a time.
+func (h *HandoffHandle) Handoff(ctx context.Context, do func(ready func(), stop <-chan struct{})) error {
+	h.handoffM.Lock()
+	defer h.handoffM.Unlock()
+	h.m.Lock()
+	cur := h.current
+	worker := h.worker
+	h.m.Unlock()
+	if cur == nil {
+		return errors.New("reroutine: handoff: no running invocation")
+	}
+	if do != nil {
+		worker = do
+	}
+	next := h.launch()
+	spawn(func() {
+		h.runReplacement(next, worker)
+	})
+
+	select {
+	case <-next.ready:
+	case <-next.done:
+		h.m.Lock()
+		defer h.m.Unlock()
+		if next.panicked {
+			return &PanicError{Value: next.value, Stack: next.stack}
+		}
+		return errors.New("reroutine: handoff: the replacement returned before it was ready")
+	case <-ctx.Done():
+		next.close()
+		return ctx.Err()
+	}
+
+	h.m.Lock()
+	if cur.ended || next.ended || h.current != cur {
+		h.m.Unlock()
+		next.close()
+		return errors.New("reroutine: handoff: the invocation ended during the handoff")
+	}
+	cur.next = next
+	h.current = next
+	if do != nil {
+		h.worker = do
+	}
+	h.m.Unlock()
+	cur.close()
+	return nil
+}
+
+// launch creates an invocation, stopping it straight away if the handle has
+// been stopped.
+func (h *HandoffHandle) launch() *handoffInvocation {
+	inv := &handoffInvocation{
+		stop:  make(chan struct{}),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.stopped {
+		inv.close()
+	}
+	h.live[inv] = struct{}{}
+	return inv
+}
+
+// end records that the worker of inv has returned or panicked and reports
+// whether the work had been handed off from it.
+func (h *HandoffHandle) end(inv *handoffInvocation) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+	inv.ended = true
+	delete(h.live, inv)
+	if h.current == inv {
+		h.current = nil
+	}
+	return inv.next != nil
+}
+
+// stopAll closes the stop channel of every invocation, and of those started
+// later, once the handle is stopped.
+func (h *HandoffHandle) stopAll() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.stopped = true
+	for inv := range h.live {
+		inv.close()
+	}
+}
+
+// supervise runs a supervised invocation of the worker on the calling
+// go-routine and then, for as long as the work is handed off, waits for the
+// invocation it was handed off to, re-raising its panic, if any, so that the
+// supervisor restarts it.
+func (h *HandoffHandle) supervise() {
+	inv := h.launch()
+	h.m.Lock()
+	h.current = inv
+	worker := h.worker
+	h.m.Unlock()
+	func() {
+		defer func() {
+			if h.end(inv) {
+				// Handed off, so the panic no longer concerns the supervisor.
+				if r := recover(); r != nil {
+					runHandlers(r, nil, nil)
+				}
+			}
+		}()
+		worker(inv.markReady, inv.stop)
+	}()
+	inv.close()
+	for {
+		h.m.Lock()
+		next := inv.next
+		h.m.Unlock()
+		if next == nil {
+			return
+		}
+		inv = next
+		<-inv.done
+		h.m.Lock()
+		handedOff, panicked, value := inv.next != nil, inv.panicked, inv.value
+		h.m.Unlock()
+		if !handedOff && panicked {
+			panic(value)
+		}
+	}
+}
+
+// runReplacement runs the invocation inv started by Handoff. Its panic is
+// left for the supervising go-routine to re-raise if the work was handed off
+// to it, and is passed to the PanicHandlers otherwise.
+func (h *HandoffHandle) runReplacement(inv *handoffInvocation, worker func(ready func(), stop <-chan struct{})) {
+	defer close(inv.done)
+	defer func() {
+		r := recover()
+		h.m.Lock()
+		inv.ended = true
+		delete(h.live, inv)
+		adopted := h.current == inv
+		if adopted {
+			h.current = nil
+		}
+		handedOff := inv.next != nil
+		if r != nil && !handedOff {
+			inv.panicked, inv.value, inv.stack = true, r, captureStack()
+		}
+		h.m.Unlock()
+		inv.close()
+		if r != nil && (handedOff || !adopted) {
+			runHandlers(r, nil, nil)
+		}
+	}()
+	worker(inv.markReady, inv.stop)
+}
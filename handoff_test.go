@@ -0,0 +1,109 @@
+package reroutine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	captureLogs(t)
+	var running, generation int32
+	ready := make(chan int32, 4)
+	overlapped := make(chan int32, 4)
+	h := GoHandoff(nil, func(markReady func(), stop <-chan struct{}) {
+		g := atomic.AddInt32(&generation, 1)
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		markReady()
+		ready <- g
+		<-stop
+		overlapped <- n
+	})
+	if g := <-ready; g != 1 {
+		t.Fatalf("expected the first invocation, got %d", g)
+	}
+	if err := h.Handoff(timeout(t, time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	if g := <-ready; g != 2 {
+		t.Errorf("expected the replacement to be ready, got %d", g)
+	}
+	if n := <-overlapped; n != 1 {
+		t.Errorf("expected the first invocation to be stopped, got %d", n)
+	}
+	if atomic.LoadInt32(&running) != 1 {
+		t.Error("expected the replacement to keep running")
+	}
+	h.Stop()
+	h.Wait()
+	if n := <-overlapped; n != 2 {
+		t.Errorf("expected the replacement to be stopped with the handle, got %d", n)
+	}
+	// The replacement returns once stopped, which can be seen as a clean exit.
+	if reason := h.Reason(); (reason != StopReasonStopped && reason != StopReasonClean) || h.Restarts() != 0 {
+		t.Errorf("expected a stop without restarts, got %v after %d restarts", reason, h.Restarts())
+	}
+}
+
+func TestHandoff_Failed(t *testing.T) {
+	captureLogs(t)
+	started := make(chan struct{})
+	h := GoHandoff(nil, func(markReady func(), stop <-chan struct{}) {
+		close(started)
+		<-stop
+	})
+	defer h.Wait()
+	defer h.Stop()
+	<-started
+
+	var panicErr *PanicError
+	err := h.Handoff(timeout(t, time.Second), func(func(), <-chan struct{}) {
+		panic("not ready")
+	})
+	if !errors.As(err, &panicErr) || panicErr.Value != "not ready" {
+		t.Errorf("expected the replacement's panic, got %v", err)
+	}
+	err = h.Handoff(timeout(t, 10*time.Millisecond), func(_ func(), stop <-chan struct{}) {
+		<-stop
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected to time out, got %v", err)
+	}
+	if h.Reason() != StopReasonNone {
+		t.Errorf("expected the first invocation to carry on, got %v", h.Reason())
+	}
+}
+
+func TestHandoff_ReplacementPanics(t *testing.T) {
+	captureLogs(t)
+	var generation int32
+	ready := make(chan int32, 4)
+	adopted := make(chan struct{})
+	h := GoHandoff(nil, func(markReady func(), stop <-chan struct{}) {
+		g := atomic.AddInt32(&generation, 1)
+		markReady()
+		ready <- g
+		if g == 2 {
+			<-adopted
+			panic("panicked")
+		}
+		<-stop
+	}, WithBackoff(0, 0))
+	<-ready
+	if err := h.Handoff(timeout(t, time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	close(adopted)
+	<-ready
+	if g := <-ready; g != 3 {
+		t.Errorf("expected the replacement to be restarted, got %d", g)
+	}
+	h.Stop()
+	h.Wait()
+	if h.Restarts() != 1 {
+		t.Errorf("expected one restart, got %d", h.Restarts())
+	}
+}
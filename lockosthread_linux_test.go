@@ -0,0 +1,27 @@
+//go:build linux
+
+package reroutine
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestGo_LockOSThread(t *testing.T) {
+	captureLogs(t)
+	i := 0
+	BlockingGo(nil, func() {
+		tid := syscall.Gettid()
+		for j := 0; j < 100; j++ {
+			runtime.Gosched()
+			if syscall.Gettid() != tid {
+				t.Error("expected the invocation to stay on its OS thread")
+				return
+			}
+		}
+		if i++; i < 3 {
+			panic("panicked")
+		}
+	}, WithLockOSThread(true))
+}
@@ -0,0 +1,25 @@
+package reroutine
+
+import "time"
+
+// BackoffSecondsTotal is the conventional name of the counter of the time
+// supervisors spend backing off before restarting their workers, in seconds.
+const BackoffSecondsTotal = "reroutine_backoff_seconds_total"
+
+// Metrics receives the measurements of supervisors configured with
+// WithMetrics, so that they can be exported to a metrics system without this
+// package depending on one.
+type Metrics interface {
+	// AddBackoff is called with the time the supervisor of the worker named
+	// name, as configured with WithName, spent in a single backoff, including
+	// one cut short by stopping. A Prometheus adapter would add it to the
+	// BackoffSecondsTotal counter, labelled by name.
+	AddBackoff(name string, d time.Duration)
+}
+
+// WithMetrics reports the supervisor's measurements to m.
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
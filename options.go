@@ -0,0 +1,611 @@
+package reroutine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// Option configures how a supervised go-routine is restarted.
+type Option func(*options)
+
+type options struct {
+	name string
+	tags map[string]string
+
+	maxRestarts      int
+	restartIf        func(interface{}) bool
+	onRestart        func(int, interface{}) bool
+	restartDelay     func(int, interface{}) time.Duration
+	reallyCrash      *bool
+	stopIsError      bool
+	policy           RestartPolicy
+	limiter          *tokenBucket
+	cost             int
+	semaphore        Semaphore
+	semaphoreWeight  int64
+	recovery         *recoveryGate
+	recoveryPriority func(name string) int
+
+	onPanic          func(PanicInfo)
+	fingerprintDepth int
+	transform        func(interface{}) interface{}
+	finalizer        func()
+	executor         Executor
+	inline           bool
+	flight           chan struct{} // held by the running invocation
+	logStack         bool
+	repeatWindow     time.Duration
+	logRepeat        func(string)
+	logFilter        func(interface{}) bool
+	clock            Clock
+	wrapper          func(f func()) func()
+	middleware       []func(next func()) func()
+	lockOSThread     bool
+	events           bool
+	eventBuffer      int
+	eventDelivery    EventDelivery
+	eventWriter      io.Writer
+	metrics          Metrics
+	labels           pprof.LabelSet
+	hasLabels        bool
+	onCleanExit      func()
+	onGiveUp         func(context.Context, StopReason, error)
+	fallback         func()
+	fallbackOpts     []Option
+	onStable         func()
+	stableAfter      time.Duration
+	trigger          <-chan struct{}
+	triggerDebounce  time.Duration
+
+	backoffMin time.Duration
+	backoffMax time.Duration
+	budget     time.Duration
+}
+
+func newOptions(opts []Option) *options {
+	o := applyOptions(opts)
+	if o.recovery != nil {
+		var slot Semaphore = recoverySlot{gate: o.recovery, priority: o.recoveryPriority(o.name)}
+		if o.semaphore != nil {
+			slot = chainedSemaphore{first: o.semaphore, n: o.semaphoreWeight, then: slot}
+		}
+		o.semaphore, o.semaphoreWeight = slot, 1
+	}
+	return o
+}
+
+func applyOptions(opts []Option) *options {
+	o := &options{cost: 1, executor: goExecutor{}, logStack: LogStackTrace, clock: realClock{}}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Validate checks opts without launching anything, so that a supervisor
+// configured at runtime, for example from a config file, can fail fast at
+// startup. It returns an error describing every problem it finds, such as a
+// negative backoff, a backoff whose min exceeds its max, a nil clock or
+// executor, or a negative event buffer, including in the options passed to
+// WithFallback. Values documented as disabling a feature, such as a
+// WithMaxRestarts of zero or less, are valid. It's a dry run: launching a
+// go-routine doesn't validate its options, so calling Validate is up to the
+// caller.
+func Validate(opts ...Option) error {
+	return applyOptions(opts).validate()
+}
+
+func (o *options) validate() error {
+	problems := o.problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("reroutine: invalid options: %s", strings.Join(problems, "; "))
+}
+
+// problems describes what's wrong with o, if anything.
+func (o *options) problems() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if o.backoffMin < 0 {
+		add("WithBackoff: min %v is negative", o.backoffMin)
+	}
+	if o.backoffMax > 0 && o.backoffMin > o.backoffMax {
+		add("WithBackoff: min %v exceeds max %v", o.backoffMin, o.backoffMax)
+	}
+	if o.clock == nil {
+		add("WithClock: nil clock")
+	}
+	if o.executor == nil {
+		add("WithExecutor: nil executor")
+	}
+	if o.semaphore != nil && o.semaphoreWeight <= 0 {
+		add("WithRestartSemaphore: weight %d isn't positive", o.semaphoreWeight)
+	}
+	if o.recovery != nil && o.recoveryPriority == nil {
+		add("GroupWithRecoveryOrder: nil priority")
+	}
+	if o.eventBuffer < 0 {
+		add("WithEvents: buffer %d is negative", o.eventBuffer)
+	}
+	if o.eventDelivery < EventDropOldest || o.eventDelivery > EventBlock {
+		add("WithEventDelivery: unknown mode %d", o.eventDelivery)
+	}
+	if o.fallback != nil {
+		for _, problem := range applyOptions(o.fallbackOpts).problems() {
+			add("WithFallback: %s", problem)
+		}
+	}
+	return problems
+}
+
+// WithName names the supervised go-routine, to identify it in Snapshot.
+func WithName(name string) Option {
+	return func(o *options) {
+		o.name = name
+	}
+}
+
+// WithTags attaches tags to the go-routine, which are included in the
+// PanicInfo passed to the handler configured with WithOnPanic so that crash
+// reporters can label the panics they report. Passing WithTags more than once
+// merges the tags, with later values taking precedence.
+func WithTags(tags map[string]string) Option {
+	return func(o *options) {
+		if o.tags == nil {
+			o.tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			o.tags[k] = v
+		}
+	}
+}
+
+// WithMaxRestarts limits the number of times the go-routine is restarted after
+// panicking. Once the limit has been reached, the next panic is not restarted
+// and supervision ends. A value of zero or less means there is no limit. With a
+// limit, the default log line of each restart counts down the restarts left,
+// as in "restart 3 of 5, 2 remaining", and the final one says how many
+// attempts were made before giving up.
+func WithMaxRestarts(n int) Option {
+	return func(o *options) {
+		o.maxRestarts = n
+	}
+}
+
+// WithRestartIf only restarts the go-routine when fn returns true for the
+// recovered panic value. When fn returns false, supervision ends.
+func WithRestartIf(fn func(recovered interface{}) bool) Option {
+	return func(o *options) {
+		o.restartIf = fn
+	}
+}
+
+// WithOnRestart calls fn with the attempt that panicked and the recovered value
+// whenever the go-routine is about to be restarted. It's called after every
+// other option has agreed to restart, but before any backoff.
+func WithOnRestart(fn func(attempt int, recovered interface{})) Option {
+	return WithRestartHook(func(attempt int, recovered interface{}) bool {
+		fn(attempt, recovered)
+		return true
+	})
+}
+
+// WithRestartHook is like WithOnRestart, but fn decides whether the restart
+// goes ahead. When fn returns false, supervision ends with
+// StopReasonCallbackAborted. This lets state outside of the panic, such as a
+// feature flag, decide whether to keep the worker running.
+func WithRestartHook(fn func(attempt int, recovered interface{}) (restart bool)) Option {
+	return func(o *options) {
+		o.onRestart = fn
+	}
+}
+
+// WithRestartDelay calls fn with the attempt that panicked and the recovered
+// value whenever the go-routine is about to be restarted, after the callback
+// configured with WithOnRestart or WithRestartHook. A positive duration
+// returned by fn replaces the delay before the restart, taking precedence over
+// WithBackoff, WithRestartPolicy and a panic with a Backoff, so that a
+// particular panic can be given a much longer delay. Zero or less keeps the
+// delay those options computed. Either way, the delay is still cut short by
+// WithRetryBudget.
+func WithRestartDelay(fn func(attempt int, recovered interface{}) time.Duration) Option {
+	return func(o *options) {
+		o.restartDelay = fn
+	}
+}
+
+// WithRestartPolicy lets policy decide whether to restart a panicking
+// go-routine, and how long to wait first. It's consulted after WithMaxRestarts
+// and WithRestartIf, and the go-routine waits for the longer of the policy's
+// delay and the backoff. Passing WithRestartPolicy more than once combines the
+// policies as CombinePolicies does.
+func WithRestartPolicy(policy RestartPolicy) Option {
+	return func(o *options) {
+		if o.policy != nil {
+			policy = CombinePolicies(o.policy, policy)
+		}
+		o.policy = policy
+	}
+}
+
+// WithReallyCrash overrides ReallyCrash for this go-routine only. When crash
+// is true, a panic is logged and passed to the handlers and then re-raised,
+// crashing the process, instead of being restarted. When it's false, the
+// go-routine is restarted even if ReallyCrash is set.
+func WithReallyCrash(crash bool) Option {
+	return func(o *options) {
+		o.reallyCrash = &crash
+	}
+}
+
+// WithStopIsError makes stopping the go-routine before its worker returned
+// without panicking count as a failure when isError is true: once supervision
+// ends with StopReasonStopped, Handle.Err, Supervisor.Err and the function
+// returned by GoTombValue report ErrStopped instead of a nil error, unless a
+// more specific error was already recorded, such as the reason a tomb
+// implementing ErrReporter was killed with. This lets a worker supervised with
+// GoResult or GoTombValue be used both where stopping it is benign, the
+// default, and where it must complete or fail.
+func WithStopIsError(isError bool) Option {
+	return func(o *options) {
+		o.stopIsError = isError
+	}
+}
+
+// WithRestartRate throttles restarts using a token bucket that refills at
+// perSecond tokens per second and holds at most burst tokens. The bucket is
+// created when WithRestartRate is called, so passing the same Option to several
+// supervisors, or to a Group, makes them share a single limiter. Restarts wait
+// for tokens, as told by the clock configured with WithClock, until the stop
+// condition is met. A perSecond of zero or less
+// disables the limit.
+func WithRestartRate(perSecond float64, burst int) Option {
+	var b *tokenBucket
+	if perSecond > 0 {
+		b = newTokenBucket(perSecond, burst)
+	}
+	return func(o *options) {
+		o.limiter = b
+	}
+}
+
+// WithRestartCost sets how many tokens each restart debits from the limiter
+// configured with WithRestartRate. The default cost is one, and a cost of zero
+// restarts without consuming tokens. A cost larger than the limiter's burst
+// does not deadlock: the restart waits until enough tokens would have
+// accumulated and then proceeds, leaving the limiter in debt.
+func WithRestartCost(cost int) Option {
+	return func(o *options) {
+		if cost < 0 {
+			cost = 0
+		}
+		o.cost = cost
+	}
+}
+
+// WithRestartSemaphore gates restarts with sem, which may be shared with other
+// supervisors and other code. Before each restart the supervisor acquires n
+// units, after any backoff and restart rate limit, and releases them once the
+// restarted invocation has started, so sem bounds how many workers restart at
+// the same time. Acquiring is abandoned once the stop condition is met.
+func WithRestartSemaphore(sem Semaphore, n int64) Option {
+	return func(o *options) {
+		o.semaphore = sem
+		o.semaphoreWeight = n
+	}
+}
+
+// WithOnPanic calls fn with a description of every panic recovered by the
+// supervisor, after the global PanicHandlers have run.
+func WithOnPanic(fn func(PanicInfo)) Option {
+	return func(o *options) {
+		o.onPanic = fn
+	}
+}
+
+// WithFingerprint enables crash fingerprinting, which hashes the top depth
+// frames of each panic's stack so that repeated panics caused by the same bug
+// share a PanicInfo.Fingerprint, and counts how often each fingerprint occurs.
+// A depth of zero or less disables fingerprinting.
+func WithFingerprint(depth int) Option {
+	return func(o *options) {
+		o.fingerprintDepth = depth
+	}
+}
+
+// WithRecoverTransform applies fn to every recovered panic value before it is
+// used for anything else, including logging, the restart decision and the
+// panic handlers. It can be used to unwrap panics wrapped by other frameworks
+// or to redact sensitive data before it reaches logs and crash reporters.
+func WithRecoverTransform(fn func(recovered interface{}) interface{}) Option {
+	return func(o *options) {
+		o.transform = fn
+	}
+}
+
+// WithFinalizer runs fn once supervision has ended, for example to flush state
+// on shutdown. fn runs synchronously on the supervising go-routine, so
+// BlockingGo and Handle.Wait do not return until it has. When supervision is
+// stopped while an invocation is running, that invocation is left running and
+// fn can overlap it; combine with WithInline to have fn run strictly after the
+// worker has returned. A panic in fn is recovered and logged, and is never
+// re-raised, even when ReallyCrash is set.
+func WithFinalizer(fn func()) Option {
+	return func(o *options) {
+		o.finalizer = fn
+	}
+}
+
+// WithExecutor submits every invocation of the worker to e instead of starting
+// a new go-routine for it. Invocations that are still queued when the
+// go-routine is stopped are skipped once they run. The tomb variants always
+// use the tomb to start invocations and ignore this option.
+func WithExecutor(e Executor) Option {
+	return func(o *options) {
+		o.executor = e
+	}
+}
+
+// WithOnCleanExit calls fn whenever the worker returns without panicking, which
+// ends supervision. It is not called when supervision ends for any other
+// reason, which makes it possible to tell a worker that finished its job apart
+// from one that crashed and was given up on.
+func WithOnCleanExit(fn func()) Option {
+	return func(o *options) {
+		o.onCleanExit = fn
+	}
+}
+
+// WithOnGiveUp calls fn on its own go-routine once supervision has ended
+// because the supervisor gave up, for example to notify an orchestrator. fn
+// receives why the supervisor gave up and the error it gave up with, such as
+// a *MaxRestartsError, and ctx reports the last attempt through
+// AttemptFromContext. Since the supervisor doesn't wait for fn, it may block
+// on I/O; use Handle.WaitGiveUpCallback to wait for it to return. A panic in
+// fn is recovered and logged.
+func WithOnGiveUp(fn func(ctx context.Context, reason StopReason, err error)) Option {
+	return func(o *options) {
+		o.onGiveUp = fn
+	}
+}
+
+// WithFallback supervises do with opts, instead of ending supervision, once the
+// supervisor gives up on the primary worker, for example because it exhausted
+// WithMaxRestarts, so that a degraded worker can take over. The primary's
+// give up is handled as usual first, including its WithOnGiveUp callback and
+// finalizer. The fallback then starts afresh with only opts, which may
+// configure another fallback in turn, and the handle reports on the fallback
+// from then on: Reason, Restarts and the other accessors describe it, Events
+// returns its events if opts enable them, and UsingFallback reports true.
+// Stopping the handle stops whichever worker is active. There's no fallback
+// when the worker returns, is stopped, or its panic is re-raised, and it only
+// applies to the functions that return a Handle.
+func WithFallback(do func(), opts ...Option) Option {
+	return func(o *options) {
+		o.fallback = do
+		o.fallbackOpts = opts
+	}
+}
+
+// WithOnStable calls fn once an invocation of the go-routine has run for d
+// without panicking. It's re-armed every time the go-routine is restarted, so
+// following a panic fn is called again once the new invocation has been stable
+// for d. It's not called once supervision has ended. It also sets the
+// stability window used by Handle.WaitHealthy, as WithStabilityWindow does.
+func WithOnStable(d time.Duration, fn func()) Option {
+	return func(o *options) {
+		o.stableAfter = d
+		o.onStable = fn
+	}
+}
+
+// WithStabilityWindow considers the go-routine healthy, for Handle.WaitHealthy,
+// once an invocation has run for d without panicking. Use WithOnStable to also
+// be called back when that happens.
+func WithStabilityWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.stableAfter = d
+	}
+}
+
+// WithRestartTrigger restarts the go-routine whenever a value is received on
+// trigger, for example to reload its configuration when a file changes. The
+// context passed to the worker of GoContext and BlockingGoContext is cancelled
+// so that the running invocation returns promptly; other workers, which have
+// no way to be told, are restarted once they return. Triggered restarts don't
+// back off or count as restarts, see Supervisor.TriggeredRestarts. A value
+// received while the worker isn't running is ignored, and closing trigger
+// stops further triggers. Tomb workers ignore this option. See
+// WithTriggerDebounce to coalesce bursts of values.
+func WithRestartTrigger(trigger <-chan struct{}) Option {
+	return func(o *options) {
+		o.trigger = trigger
+	}
+}
+
+// WithTriggerDebounce coalesces the values received on the channel passed to
+// WithRestartTrigger within d of each other into a single restart, for noisy
+// sources such as a file watcher firing several events per save. The restart
+// happens once no value has been received for d, so the last value of a burst
+// is never missed, even if trigger is closed in the meantime. A d of zero or
+// less restarts on every value, which is the default.
+func WithTriggerDebounce(d time.Duration) Option {
+	return func(o *options) {
+		o.triggerDebounce = d
+	}
+}
+
+// WithBackoff waits before restarting a panicking go-routine. The first restart
+// waits min, and every following restart waits twice as long as the previous
+// one, up to max. A max of zero or less means the delay is not capped. The wait
+// is interrupted as soon as the go-routine is stopped, including when its tomb
+// starts dying.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.backoffMin = min
+		o.backoffMax = max
+	}
+}
+
+// WithRetryBudget stops restarting a panicking go-routine once d has elapsed
+// since it was first launched, regardless of how many restarts that took.
+// A backoff that would outlast the remaining budget is cut short so that the
+// last restart happens as the budget runs out.
+// A d of zero or less means there is no budget.
+func WithRetryBudget(d time.Duration) Option {
+	return func(o *options) {
+		o.budget = d
+	}
+}
+
+// WithInline runs every invocation of the worker on the supervising go-routine
+// instead of starting a new go-routine for each one, so a supervisor only ever
+// uses a single go-routine no matter how often the worker restarts. The
+// trade-off is that stopping waits for the running invocation: once the stop
+// condition is met, BlockingGo and Handle.Wait only return after the running
+// invocation does, so the worker must honour the stop condition itself.
+// WithExecutor is ignored when WithInline is set.
+func WithInline() Option {
+	return func(o *options) {
+		o.inline = true
+	}
+}
+
+// WithSingleFlight guarantees that invocations of the worker never overlap:
+// an invocation only starts once the previous one has fully returned. Within
+// a single supervisor that's always the case, but once the stop condition is
+// met the running invocation is left to return on its own, so supervising the
+// same worker again, for example by calling BlockingGo again after it was
+// stopped, can start an invocation while the previous one is still running.
+// The guarantee holds for every supervisor the returned option is passed to,
+// so create it once and reuse it:
+//
+//	flight := reroutine.WithSingleFlight()
+//	reroutine.BlockingGo(stop, do, flight)
+//	// Waits for the invocation of do left running by stop.
+//	reroutine.BlockingGo(nil, do, flight)
+//
+// Invocations that are waiting for the previous one are abandoned once the
+// stop condition is met. It doesn't apply to the tomb variants, whose
+// invocations are tracked by the tomb.
+func WithSingleFlight() Option {
+	flight := make(chan struct{}, 1)
+	return func(o *options) {
+		o.flight = flight
+	}
+}
+
+// WithLogStackTrace overrides LogStackTrace for the panics logged by this
+// supervisor. The stack is always available to handlers through
+// PanicInfo.Stack regardless of this setting.
+func WithLogStackTrace(enabled bool) Option {
+	return func(o *options) {
+		o.logStack = enabled
+	}
+}
+
+// WithRepeatLogging only logs the first panic of a burst in full, where a
+// burst is a series of panics that each follow the previous one within window.
+// The following panics of the burst are passed to logRepeat instead of
+// PrintError, so that they can be logged at a lower severity, without their
+// stack trace and with a note counting the repeat. A nil logRepeat uses
+// PrintError. By default, every panic is logged in full.
+func WithRepeatLogging(window time.Duration, logRepeat func(string)) Option {
+	return func(o *options) {
+		o.repeatWindow = window
+		o.logRepeat = logRepeat
+	}
+}
+
+// WithLogFilter suppresses the default log line for the panics for which fn
+// returns false, for example for panics that are known to be benign. The panic
+// is still handled and the worker restarted as configured, and the other
+// PanicHandlers and WithOnPanic still see it. Panics with http.ErrAbortHandler
+// are never logged. The filter also applies while SetVerbose is on.
+func WithLogFilter(fn func(recovered interface{}) bool) Option {
+	return func(o *options) {
+		o.logFilter = fn
+	}
+}
+
+// WithClock makes the supervisor use c to tell the time and to wait for
+// backoffs instead of the wall clock, which is mostly useful in tests.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// WithGoroutineWrapper lets wrap decorate the function that runs each
+// invocation of the worker before it's handed to the go-routine that runs it,
+// for example to copy a tracing context or pprof labels across the go-routine
+// boundary that reroutine introduces. wrap must return a function that calls f
+// exactly once. It applies to every variant, including the tomb variants and
+// WithInline, where the invocation runs on the supervising go-routine.
+func WithGoroutineWrapper(wrap func(f func()) func()) Option {
+	return func(o *options) {
+		o.wrapper = wrap
+	}
+}
+
+// WithMiddleware wraps every invocation of the worker in mw, for cross-cutting
+// behaviour such as logging, timing or tracing. The first middleware is the
+// outermost: it's called first and calls the next one, down to the worker.
+// Unlike WithGoroutineWrapper, the chain runs inside the frame that recovers
+// panics, so a panic propagates through every middleware, running their
+// deferred functions, before it's recovered. Each middleware must call next
+// exactly once. Calling WithMiddleware more than once appends to the chain.
+func WithMiddleware(mw ...func(next func()) func()) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+// WithEvents enables the event stream returned by Handle.Events, buffering up
+// to buffer events. What happens once the buffer is full is controlled by
+// WithEventDelivery.
+func WithEvents(buffer int) Option {
+	return func(o *options) {
+		o.events = true
+		o.eventBuffer = buffer
+	}
+}
+
+// WithEventDelivery sets what happens to events delivered while the buffer
+// configured with WithEvents is full. It defaults to EventDropOldest.
+func WithEventDelivery(mode EventDelivery) Option {
+	return func(o *options) {
+		o.eventDelivery = mode
+	}
+}
+
+// WithLockOSThread locks the go-routine running each invocation of the worker
+// to its OS thread with runtime.LockOSThread, for workers that call into C
+// libraries relying on thread-local state or otherwise need thread affinity.
+// The thread is unlocked when the invocation returns or panics. It's off by
+// default: while locked, the thread can't run any other go-routine, and with
+// WithInline it's the supervising go-routine that is locked.
+func WithLockOSThread(lock bool) Option {
+	return func(o *options) {
+		o.lockOSThread = lock
+	}
+}
+
+// WithPprofLabels runs each invocation of the worker with the given pprof
+// labels, so that CPU profiles and goroutine dumps attribute the go-routine to
+// the supervisor that launched it. labels are key/value pairs, as accepted by
+// pprof.Labels, which panics on an odd number of arguments.
+func WithPprofLabels(labels ...string) Option {
+	set := pprof.Labels(labels...)
+	return func(o *options) {
+		o.labels = set
+		o.hasLabels = len(labels) > 0
+	}
+}
@@ -0,0 +1,60 @@
+package reroutine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := [][]Option{
+		nil,
+		{WithBackoff(time.Second, time.Minute), WithMaxRestarts(3)},
+		{WithBackoff(time.Minute, 0), WithMaxRestarts(-1), WithRetryBudget(-time.Second)},
+		{WithEvents(0), WithEventDelivery(EventBlock)},
+	}
+	for _, opts := range valid {
+		if err := Validate(opts...); err != nil {
+			t.Errorf("expected the options to be valid, got %v", err)
+		}
+	}
+
+	invalid := []struct {
+		opts    []Option
+		problem string
+	}{
+		{[]Option{WithBackoff(-time.Second, 0)}, "WithBackoff: min -1s is negative"},
+		{[]Option{WithBackoff(time.Minute, time.Second)}, "WithBackoff: min 1m0s exceeds max 1s"},
+		{[]Option{WithClock(nil)}, "WithClock: nil clock"},
+		{[]Option{WithExecutor(nil)}, "WithExecutor: nil executor"},
+		{[]Option{WithRestartSemaphore(make(chanSemaphore, 1), 0)}, "WithRestartSemaphore: weight 0 isn't positive"},
+		{[]Option{WithEvents(-1)}, "WithEvents: buffer -1 is negative"},
+		{[]Option{WithEventDelivery(EventDelivery(42))}, "WithEventDelivery: unknown mode 42"},
+		{[]Option{WithFallback(func() {}, WithClock(nil))}, "WithFallback: WithClock: nil clock"},
+	}
+	for _, test := range invalid {
+		err := Validate(test.opts...)
+		if err == nil || err.Error() != "reroutine: invalid options: "+test.problem {
+			t.Errorf("expected %q, got %v", test.problem, err)
+		}
+	}
+
+	err := Validate(WithBackoff(-time.Second, 0), WithEvents(-1))
+	if err == nil || !strings.Contains(err.Error(), "min -1s is negative; WithEvents") {
+		t.Errorf("expected every problem to be reported, got %v", err)
+	}
+
+	// Launching doesn't validate, so a backoff whose min exceeds its max is
+	// still capped at max.
+	clock := newFakeClock()
+	captureLogs(t)
+	h := Go(nil, func() {
+		panic("panicked")
+	}, WithClock(clock), WithBackoff(time.Minute, time.Second))
+	<-clock.added
+	if at, ok := h.NextRestart(); !ok || !at.Equal(clock.Now().Add(time.Second)) {
+		t.Errorf("expected the restart to be scheduled in 1s, got %v, %v", at, ok)
+	}
+	h.Stop()
+	h.Wait()
+}
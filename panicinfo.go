@@ -0,0 +1,225 @@
+package reroutine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PanicInfo describes a panic recovered by a supervisor.
+type PanicInfo struct {
+	// Value is the value that was recovered.
+	Value interface{}
+	// Stack is the formatted stack trace of the panicking go-routine.
+	Stack []byte
+	// Frames are the parsed stack frames of the panicking go-routine, starting
+	// with the frame that panicked.
+	Frames []Frame
+	// Panics is the number of panics that were in progress when Value was
+	// recovered. It's greater than one when a deferred function panicked while
+	// the worker was already panicking. Go only allows the last panic to be
+	// recovered, so the earlier panics are only visible through their frames
+	// in Stack and Frames.
+	Panics int
+	// Attempt is the invocation of the worker that panicked, starting at one.
+	Attempt int
+	// Goroutine is the id of the go-routine that panicked, parsed from Stack,
+	// or zero if it couldn't be parsed. It's for diagnostics only, see
+	// Supervisor.Goroutine.
+	Goroutine int64
+	// Name is the name of the worker configured with WithName, if any.
+	Name string
+	// Tags are the tags configured with WithTags, if any.
+	Tags map[string]string
+	// Time is when the panic was recovered.
+	Time time.Time
+	// Fingerprint identifies the crash signature of the panic, derived from the
+	// top frames of the stack. It's only set when fingerprinting is enabled
+	// with WithFingerprint.
+	Fingerprint string
+	// Occurrences is the number of panics with the same fingerprint recovered
+	// by the supervisor so far, including this one. It's only set when
+	// fingerprinting is enabled with WithFingerprint.
+	Occurrences int
+}
+
+// JSON returns a JSON object describing the panic, ready to be forwarded to a
+// crash reporter. The recovered value is included as is if it can be
+// marshalled, and as its string form otherwise, including for errors, which
+// would usually marshal to an empty object.
+func (info PanicInfo) JSON() ([]byte, error) {
+	frames := make([]jsonFrame, len(info.Frames))
+	for i, f := range info.Frames {
+		frames[i] = jsonFrame(f)
+	}
+	return json.Marshal(jsonPanicInfo{
+		Value:       jsonValue(info.Value),
+		Frames:      frames,
+		Goroutine:   info.goroutine(),
+		Name:        info.Name,
+		Tags:        info.Tags,
+		Attempt:     info.Attempt,
+		Panics:      info.Panics,
+		Time:        info.Time,
+		Fingerprint: info.Fingerprint,
+	})
+}
+
+// goroutine returns Goroutine, falling back to parsing Stack for a PanicInfo
+// that wasn't created by a supervisor.
+func (info PanicInfo) goroutine() int64 {
+	if info.Goroutine != 0 {
+		return info.Goroutine
+	}
+	return goroutineID(info.Stack)
+}
+
+type jsonPanicInfo struct {
+	Value       json.RawMessage   `json:"value"`
+	Frames      []jsonFrame       `json:"frames"`
+	Goroutine   int64             `json:"goroutine,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Attempt     int               `json:"attempt"`
+	Panics      int               `json:"panics"`
+	Time        time.Time         `json:"time"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+}
+
+type jsonFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// jsonValue marshals the recovered value r, falling back to its string form.
+func jsonValue(r interface{}) json.RawMessage {
+	if _, ok := r.(error); !ok {
+		if b, err := json.Marshal(r); err == nil {
+			return b
+		}
+	}
+	b, _ := json.Marshal(fmt.Sprint(r))
+	return b
+}
+
+// goroutineID parses the id of the go-routine from the header of its stack
+// trace, returning zero if it can't be found.
+func goroutineID(stack []byte) int64 {
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		if id, err := strconv.ParseInt(string(stack[:i]), 10, 64); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+// headerBuffers pools the buffers that only fit the header of a stack trace,
+// which escape to the heap through runtime.Stack.
+var headerBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([64]byte)
+	},
+}
+
+// currentGoroutineID returns the id of the calling go-routine, formatting only
+// the header of its stack trace.
+func currentGoroutineID() int64 {
+	buf := headerBuffers.Get().(*[64]byte)
+	defer headerBuffers.Put(buf)
+	return goroutineID(buf[:runtime.Stack(buf[:], false)])
+}
+
+// Frame is a single parsed stack frame.
+type Frame struct {
+	Function string
+	File     string
+	Line     int
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%s\n\t%s:%d", f.Function, f.File, f.Line)
+}
+
+// stackBuffers pools the buffers stack traces are formatted into, so that
+// each panic only allocates as much as its stack trace needs.
+var stackBuffers = sync.Pool{
+	New: func() interface{} {
+		// Same as stdlib http server code. Manually allocate stack trace buffer
+		// size to prevent excessively large logs
+		const size = 64 << 10
+		b := make([]byte, size)
+		return &b
+	},
+}
+
+// captureStack returns the formatted stack trace of the calling go-routine.
+func captureStack() []byte {
+	buf := stackBuffers.Get().(*[]byte)
+	defer stackBuffers.Put(buf)
+	stack := *buf
+	return append([]byte(nil), stack[:runtime.Stack(stack, false)]...)
+}
+
+// captureAllStacks returns the formatted stack traces of all go-routines,
+// growing the buffer as needed up to a limit.
+func captureAllStacks() []byte {
+	const max = 8 << 20
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= max {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// captureFrames returns the frames of the calling go-routine that lead up to
+// the panic currently being handled, along with the number of panics in
+// progress. It must be called from a deferred function while panicking.
+func captureFrames() ([]Frame, int) {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(0, pcs)]
+	var frames []Frame
+	panics := 0
+	it := runtime.CallersFrames(pcs)
+	for {
+		f, more := it.Next()
+		if panics > 0 {
+			frames = append(frames, Frame{Function: f.Function, File: f.File, Line: f.Line})
+		}
+		if f.Function == "runtime.gopanic" {
+			panics++
+		}
+		if !more {
+			break
+		}
+	}
+	return frames, panics
+}
+
+// fingerprint hashes the top depth frames into a crash signature. Frames in
+// the runtime, such as runtime.sigpanic for runtime errors, are skipped so that
+// they don't use up the depth.
+func fingerprint(frames []Frame, depth int) string {
+	h := fnv.New64a()
+	for _, f := range frames {
+		if depth <= 0 {
+			break
+		}
+		if strings.HasPrefix(f.Function, "runtime.") {
+			continue
+		}
+		fmt.Fprintf(h, "%s:%d\n", f.Function, f.Line)
+		depth--
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
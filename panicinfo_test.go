@@ -0,0 +1,181 @@
+package reroutine
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func panicA() { panic("a") }
+func panicB() { panic("b") }
+
+func TestPanicInfo_Fingerprint(t *testing.T) {
+	var m sync.Mutex
+	var infos []PanicInfo
+	i := 0
+	BlockingGo(make(chan struct{}), func() {
+		i++
+		if i%2 == 0 {
+			panicA()
+		}
+		panicB()
+	}, WithMaxRestarts(3), WithFingerprint(3), WithOnPanic(func(info PanicInfo) {
+		m.Lock()
+		defer m.Unlock()
+		infos = append(infos, info)
+	}))
+
+	m.Lock()
+	defer m.Unlock()
+	if len(infos) != 4 {
+		t.Fatalf("expected four panics, got %d", len(infos))
+	}
+	if !strings.HasSuffix(infos[0].Frames[0].Function, "panicB") {
+		t.Errorf("expected top frame to be panicB, got %s", infos[0].Frames[0].Function)
+	}
+	if infos[0].Fingerprint == "" || infos[0].Fingerprint != infos[2].Fingerprint {
+		t.Error("expected identical panics to share a fingerprint")
+	}
+	if infos[0].Fingerprint == infos[1].Fingerprint {
+		t.Error("expected distinct panics to have distinct fingerprints")
+	}
+	if infos[2].Occurrences != 2 || infos[3].Occurrences != 2 {
+		t.Errorf("expected each fingerprint to occur twice, got %d and %d", infos[2].Occurrences, infos[3].Occurrences)
+	}
+	for n, info := range infos {
+		if info.Attempt != n+1 {
+			t.Errorf("expected attempt %d, got %d", n+1, info.Attempt)
+		}
+	}
+}
+
+func TestPanicInfo_FingerprintSkipsRuntime(t *testing.T) {
+	frames := []Frame{
+		{Function: "runtime.panicmem"},
+		{Function: "runtime.sigpanic"},
+		{Function: "main.worker", Line: 10},
+	}
+	if fingerprint(frames, 1) != fingerprint(frames[2:], 1) {
+		t.Error("expected runtime frames not to count towards the depth")
+	}
+}
+
+func TestHandle_Fingerprints(t *testing.T) {
+	i := 0
+	h := Go(nil, func() {
+		i++
+		if i%2 == 0 {
+			panicA()
+		}
+		panicB()
+	}, WithMaxRestarts(4), WithFingerprint(3))
+	h.Wait()
+	counts := h.Fingerprints()
+	if len(counts) != 2 {
+		t.Fatalf("expected two distinct fingerprints, got %v", counts)
+	}
+	for fp, n := range counts {
+		if n != 2 && n != 3 {
+			t.Errorf("unexpected count %d for %s", n, fp)
+		}
+	}
+}
+
+func panicInDefer() {
+	defer func() {
+		panic("second")
+	}()
+	panic("first")
+}
+
+func TestPanicInfo_DoublePanic(t *testing.T) {
+	logs := captureLogs(t)
+	var info PanicInfo
+	BlockingGo(nil, panicInDefer, WithMaxRestarts(0), WithRestartIf(func(interface{}) bool {
+		return false
+	}), WithOnPanic(func(i PanicInfo) {
+		info = i
+	}))
+	if info.Value != "second" || info.Panics != 2 {
+		t.Errorf("expected the second of two panics, got %v of %d", info.Value, info.Panics)
+	}
+	lines := logs()
+	if len(lines) != 1 {
+		t.Fatalf("expected one log line, got %d", len(lines))
+	}
+	if !strings.Contains(lines[0], "second") || !strings.Contains(lines[0], "panicked 2 times") {
+		t.Errorf("expected the double panic to be reported, got %q", lines[0])
+	}
+	// The first panic site is only visible through the stack.
+	if !strings.Contains(lines[0], ".panicInDefer()") {
+		t.Errorf("expected the original panic site in the stack, got %q", lines[0])
+	}
+}
+
+func TestPanicInfo_Tags(t *testing.T) {
+	tags := map[string]string{"team": "search", "region": "eu"}
+	var infos []PanicInfo
+	i := 0
+	BlockingGo(nil, func() {
+		if i++; i < 3 {
+			panic("panicked")
+		}
+	}, WithName("indexer"), WithTags(tags), WithTags(map[string]string{"region": "us"}), WithOnPanic(func(info PanicInfo) {
+		if infos = append(infos, info); len(infos) == 1 {
+			info.Tags["team"] = "modified"
+		}
+	}))
+	tags["team"] = "modified"
+	if len(infos) != 2 {
+		t.Fatalf("expected two panics, got %d", len(infos))
+	}
+	for _, info := range infos {
+		if info.Name != "indexer" || info.Attempt == 0 || len(info.Tags) != 2 || info.Tags["region"] != "us" {
+			t.Errorf("unexpected panic info %+v", info)
+		}
+	}
+	if infos[1].Tags["team"] != "search" {
+		t.Errorf("expected each panic to carry its own copy of the tags, got %v", infos[1].Tags)
+	}
+}
+
+func TestPanicInfo_JSON(t *testing.T) {
+	var infos []PanicInfo
+	i := 0
+	BlockingGo(nil, func() {
+		switch i++; i {
+		case 1:
+			panic(map[string]int{"code": 7})
+		case 2:
+			panic(errors.New("failed"))
+		case 3:
+			panic(func() {})
+		}
+	}, WithName("indexer"), WithOnPanic(func(info PanicInfo) {
+		infos = append(infos, info)
+	}))
+	for n, expected := range []string{`{"code":7}`, `"failed"`, `"0x`} {
+		b, err := infos[n].JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded struct {
+			Value     json.RawMessage `json:"value"`
+			Frames    []Frame         `json:"frames"`
+			Goroutine int64           `json:"goroutine"`
+			Name      string          `json:"name"`
+			Attempt   int             `json:"attempt"`
+		}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(decoded.Value), expected) {
+			t.Errorf("expected value %s, got %s", expected, decoded.Value)
+		}
+		if decoded.Name != "indexer" || decoded.Attempt != n+1 || decoded.Goroutine == 0 || len(decoded.Frames) == 0 {
+			t.Errorf("unexpected payload %s", b)
+		}
+	}
+}
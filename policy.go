@@ -0,0 +1,242 @@
+package reroutine
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RestartPolicy decides whether a panicking go-routine is restarted, and how
+// long to wait first. Policies are configured with WithRestartPolicy.
+type RestartPolicy interface {
+	// Restart is called with the attempt that panicked, starting at one, and
+	// the recovered value. It returns whether to restart and the delay before
+	// doing so.
+	Restart(attempt int, recovered interface{}) (delay time.Duration, restart bool)
+}
+
+// RestartPolicyFunc adapts a function to the RestartPolicy interface.
+type RestartPolicyFunc func(attempt int, recovered interface{}) (delay time.Duration, restart bool)
+
+// Restart calls f.
+func (f RestartPolicyFunc) Restart(attempt int, recovered interface{}) (time.Duration, bool) {
+	return f(attempt, recovered)
+}
+
+// CombinePolicies returns a RestartPolicy that asks each of policies, in order,
+// and takes the most conservative decision: if any of them declines to
+// restart, the go-routine isn't restarted and the remaining policies are not
+// asked. Otherwise it's restarted after the longest of the delays they
+// returned. Without any policies, it always restarts immediately.
+func CombinePolicies(policies ...RestartPolicy) RestartPolicy {
+	return RestartPolicyFunc(func(attempt int, recovered interface{}) (time.Duration, bool) {
+		var delay time.Duration
+		for _, p := range policies {
+			d, restart := p.Restart(attempt, recovered)
+			if !restart {
+				return 0, false
+			}
+			if d > delay {
+				delay = d
+			}
+		}
+		return delay, true
+	})
+}
+
+// MaxRestartsPolicy returns a RestartPolicy that restarts at most n times, as
+// WithMaxRestarts does.
+func MaxRestartsPolicy(n int) RestartPolicy {
+	return RestartPolicyFunc(func(attempt int, _ interface{}) (time.Duration, bool) {
+		return 0, n <= 0 || attempt <= n
+	})
+}
+
+// BackoffPolicy returns a RestartPolicy that always restarts after an
+// exponential backoff, as WithBackoff does.
+func BackoffPolicy(min, max time.Duration) RestartPolicy {
+	return RestartPolicyFunc(func(attempt int, _ interface{}) (time.Duration, bool) {
+		return backoff(min, max, attempt), true
+	})
+}
+
+// DecayingBackoff is a RestartPolicy that always restarts after an exponential
+// backoff like BackoffPolicy, except that the backoff isn't driven by the
+// attempt but by a level that rises by one with every panic and decays by one
+// for every DecayInterval the go-routine ran without panicking. A go-routine
+// that panics only occasionally therefore settles on a short backoff, rather
+// than oscillating between the minimum and the maximum. It holds state, so
+// each supervisor needs its own DecayingBackoff.
+type DecayingBackoff struct {
+	// Min and Max bound the backoff, as for WithBackoff.
+	Min, Max time.Duration
+	// DecayInterval is how long the go-routine must run without panicking to
+	// lower the level by one. Zero or less means the level never decays.
+	DecayInterval time.Duration
+	// Clock is used to measure how long the go-routine ran. It defaults to
+	// the system clock.
+	Clock Clock
+
+	m         sync.Mutex
+	level     int
+	last      time.Time     // when the previous panic was recovered
+	lastDelay time.Duration // the backoff following the previous panic
+}
+
+// Restart implements RestartPolicy.
+func (b *DecayingBackoff) Restart(int, interface{}) (time.Duration, bool) {
+	clock := b.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	now := clock.Now()
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.level > 0 && b.DecayInterval > 0 {
+		// Only count the time the go-routine was running, not backing off.
+		if healthy := now.Sub(b.last) - b.lastDelay; healthy > 0 {
+			b.level -= int(healthy / b.DecayInterval)
+			if b.level < 0 {
+				b.level = 0
+			}
+		}
+	}
+	if b.level < maxBackoffLevel {
+		b.level++
+	}
+	b.last = now
+	b.lastDelay = backoff(b.Min, b.Max, b.level)
+	return b.lastDelay, true
+}
+
+// AdaptiveBackoff is a RestartPolicy that always restarts and tunes its delay
+// to how long the go-routine runs before panicking: after a run shorter than
+// HealthyRun, the delay is multiplied by Increase, and after a longer one by
+// Decrease, so a go-routine that keeps failing straight away backs off further
+// and further, while one that recovers is soon restarted quickly again. The
+// first restart, and any that the adjusted delay would bring below it, waits
+// for Min. It holds state, so each supervisor needs its own AdaptiveBackoff.
+type AdaptiveBackoff struct {
+	// Min and Max bound the delay. Min must be positive for the delay to
+	// grow. A Max of zero or less means the delay is not capped.
+	Min, Max time.Duration
+	// HealthyRun is how long the go-routine must run before panicking for
+	// the run to count as healthy, narrowing the delay.
+	HealthyRun time.Duration
+	// Increase is the factor the delay is multiplied by after a short run.
+	// It defaults to 2 if it's one or less.
+	Increase float64
+	// Decrease is the factor the delay is multiplied by after a healthy run.
+	// It defaults to 0.5 if it's zero or less, or one or more.
+	Decrease float64
+	// Clock is used to measure how long the go-routine ran. It defaults to
+	// the system clock.
+	Clock Clock
+
+	m     sync.Mutex
+	last  time.Time     // when the previous panic was recovered
+	delay time.Duration // the delay following the previous panic
+}
+
+// Restart implements RestartPolicy.
+func (b *AdaptiveBackoff) Restart(int, interface{}) (time.Duration, bool) {
+	clock := b.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	now := clock.Now()
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.last.IsZero() {
+		b.delay = b.Min
+	} else {
+		factor := b.Increase
+		if factor <= 1 {
+			factor = 2
+		}
+		// Only count the time the go-routine was running, not backing off.
+		if ran := now.Sub(b.last) - b.delay; ran >= b.HealthyRun {
+			factor = b.Decrease
+			if factor <= 0 || factor >= 1 {
+				factor = 0.5
+			}
+		}
+		b.delay = time.Duration(float64(b.delay) * factor)
+	}
+	if b.delay < b.Min {
+		b.delay = b.Min
+	}
+	if b.Max > 0 && b.delay > b.Max {
+		b.delay = b.Max
+	}
+	b.last = now
+	return b.delay, true
+}
+
+// LoadAwareBackoff is a RestartPolicy that defers restarts while the system is
+// under pressure, so that restart storms don't make an overloaded system
+// worse. It takes the decision of Base and multiplies its delay by Scale of
+// the load reported by Load, when that's greater than one.
+type LoadAwareBackoff struct {
+	// Base makes the restart decision and provides the delay to scale, for
+	// example BackoffPolicy. A nil Base always restarts without delay, which
+	// no load can scale.
+	Base RestartPolicy
+	// Load reports the current load, for example the load average divided by
+	// the number of CPUs. A nil Load disables scaling.
+	Load func() float64
+	// Scale maps the load to the factor the delay is multiplied by. It
+	// defaults to the load itself, so a load of 3 triples the delay. Factors
+	// of one or less leave the delay unchanged.
+	Scale func(load float64) float64
+	// Max caps the scaled delay. Zero or less means the delay is not capped.
+	Max time.Duration
+}
+
+// Restart implements RestartPolicy.
+func (b *LoadAwareBackoff) Restart(attempt int, recovered interface{}) (time.Duration, bool) {
+	var delay time.Duration
+	if b.Base != nil {
+		d, restart := b.Base.Restart(attempt, recovered)
+		if !restart {
+			return 0, false
+		}
+		delay = d
+	}
+	if b.Load == nil {
+		return delay, true
+	}
+	factor := b.Load()
+	if b.Scale != nil {
+		factor = b.Scale(factor)
+	}
+	if factor > 1 {
+		delay = time.Duration(float64(delay) * factor)
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay, true
+}
+
+// maxBackoffLevel bounds the level of a DecayingBackoff: past it, the delay
+// has stopped doubling for any min.
+const maxBackoffLevel = 64
+
+// backoff returns the delay before restarting after the given number of
+// restarts: min, doubled for every restart after the first and capped at max
+// unless it's zero or less. Without a cap, it stops doubling before the delay
+// would overflow.
+func backoff(min, max time.Duration, restarts int) time.Duration {
+	delay := min
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < restarts && (max <= 0 || delay < max) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,158 @@
+package reroutine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCombinePolicies(t *testing.T) {
+	after := func(d time.Duration) RestartPolicy {
+		return RestartPolicyFunc(func(int, interface{}) (time.Duration, bool) {
+			return d, true
+		})
+	}
+	never := RestartPolicyFunc(func(int, interface{}) (time.Duration, bool) {
+		return 0, false
+	})
+	for _, tt := range []struct {
+		name    string
+		policy  RestartPolicy
+		attempt int
+		delay   time.Duration
+		restart bool
+	}{
+		{"Empty", CombinePolicies(), 1, 0, true},
+		{"Longest delay", CombinePolicies(after(time.Second), after(time.Minute), after(0)), 1, time.Minute, true},
+		{"Don't restart wins", CombinePolicies(after(time.Second), never), 1, 0, false},
+		{"Don't restart wins first", CombinePolicies(never, after(time.Second)), 1, 0, false},
+		{"Backoff within max restarts", CombinePolicies(BackoffPolicy(time.Second, 0), MaxRestartsPolicy(3)), 3, 4 * time.Second, true},
+		{"Backoff beyond max restarts", CombinePolicies(BackoffPolicy(time.Second, 0), MaxRestartsPolicy(3)), 4, 0, false},
+	} {
+		if delay, restart := tt.policy.Restart(tt.attempt, "panicked"); delay != tt.delay || restart != tt.restart {
+			t.Errorf("%s: expected %v, %v, got %v, %v", tt.name, tt.delay, tt.restart, delay, restart)
+		}
+	}
+}
+
+func TestWithRestartPolicy(t *testing.T) {
+	captureLogs(t)
+	i := 0
+	h := Go(nil, func() {
+		i++
+		panic("panicked")
+	}, WithRestartPolicy(BackoffPolicy(time.Millisecond, 0)), WithRestartPolicy(MaxRestartsPolicy(2)))
+	h.Wait()
+	if h.Reason() != StopReasonPolicy || i != 3 {
+		t.Errorf("expected the policy to stop after 3 attempts, got %d (%v)", i, h.Reason())
+	}
+	s := newSupervisor([]Option{WithBackoff(time.Second, 0), WithRestartPolicy(BackoffPolicy(time.Minute, 0))})
+	if delay, _ := s.decide(1, "panicked"); delay != time.Minute {
+		t.Errorf("expected the longer delay, got %v", delay)
+	}
+}
+
+func TestDecayingBackoff(t *testing.T) {
+	clock := newFakeClock()
+	b := &DecayingBackoff{Min: time.Second, Max: time.Minute, DecayInterval: time.Hour, Clock: clock}
+	var backingOff time.Duration
+	for _, step := range []struct {
+		ran   time.Duration // how long the go-routine ran before panicking
+		delay time.Duration
+	}{
+		{0, time.Second},
+		{0, 2 * time.Second},
+		{0, 4 * time.Second},
+		{time.Hour, 4 * time.Second},
+		{2 * time.Hour, 2 * time.Second},
+		{10 * time.Hour, time.Second},
+	} {
+		clock.Advance(backingOff + step.ran)
+		delay, restart := b.Restart(0, "panicked")
+		if !restart || delay != step.delay {
+			t.Errorf("expected to restart after %v having run for %v, got %v", step.delay, step.ran, delay)
+		}
+		backingOff = delay
+	}
+}
+
+func TestBackoff_Uncapped(t *testing.T) {
+	previous := time.Duration(0)
+	for restarts := 1; restarts <= 200; restarts++ {
+		delay := backoff(time.Millisecond, 0, restarts)
+		if delay < previous {
+			t.Fatalf("expected the delay never to shrink, got %v after %v at restart %d", delay, previous, restarts)
+		}
+		previous = delay
+	}
+	if delay := backoff(time.Millisecond, 0, 1<<20); delay != previous {
+		t.Errorf("expected the delay to saturate at %v, got %v", previous, delay)
+	}
+
+	clock := newFakeClock()
+	b := &DecayingBackoff{Min: time.Millisecond, Clock: clock}
+	previous = 0
+	for i := 0; i < 200; i++ {
+		delay, _ := b.Restart(0, "panicked")
+		if delay < previous {
+			t.Fatalf("expected the decaying backoff never to shrink without decay, got %v after %v", delay, previous)
+		}
+		previous = delay
+	}
+}
+
+func TestAdaptiveBackoff(t *testing.T) {
+	clock := newFakeClock()
+	b := &AdaptiveBackoff{Min: time.Second, Max: time.Minute, HealthyRun: time.Hour, Increase: 4, Clock: clock}
+	var backingOff time.Duration
+	for _, step := range []struct {
+		ran   time.Duration // how long the go-routine ran before panicking
+		delay time.Duration
+	}{
+		{0, time.Second},
+		{0, 4 * time.Second},
+		{time.Minute, 16 * time.Second},
+		{0, time.Minute},
+		{0, time.Minute},
+		{time.Hour, 30 * time.Second},
+		{2 * time.Hour, 15 * time.Second},
+		{10 * time.Hour, 7500 * time.Millisecond},
+		{time.Hour, 3750 * time.Millisecond},
+		{time.Hour, 1875 * time.Millisecond},
+		{time.Hour, time.Second},
+		{0, 4 * time.Second},
+	} {
+		clock.Advance(backingOff + step.ran)
+		delay, restart := b.Restart(0, "panicked")
+		if !restart || delay != step.delay {
+			t.Errorf("expected to restart after %v having run for %v, got %v", step.delay, step.ran, delay)
+		}
+		backingOff = delay
+	}
+}
+
+func TestLoadAwareBackoff(t *testing.T) {
+	load := 0.5
+	b := &LoadAwareBackoff{
+		Base: BackoffPolicy(time.Second, 0),
+		Load: func() float64 { return load },
+		Max:  10 * time.Second,
+	}
+	for _, step := range []struct {
+		load  float64
+		delay time.Duration
+	}{
+		{0.5, time.Second},
+		{3, 3 * time.Second},
+		{20, 10 * time.Second},
+	} {
+		load = step.load
+		if delay, restart := b.Restart(1, "panicked"); !restart || delay != step.delay {
+			t.Errorf("expected a delay of %v under a load of %v, got %v", step.delay, step.load, delay)
+		}
+	}
+
+	b.Base = MaxRestartsPolicy(1)
+	if _, restart := b.Restart(2, "panicked"); restart {
+		t.Error("expected the base policy's decision to be kept")
+	}
+}
@@ -0,0 +1,168 @@
+package reroutine
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	globalLimiterM sync.Mutex
+	globalLimiter  *tokenBucket
+)
+
+// SetGlobalRestartRate limits the number of restarts per second across every
+// supervisor in the process, on top of any per-supervisor or per-group limit.
+// Each restart takes one token from a bucket that refills at perSecond tokens
+// per second and holds at most burst tokens; supervisors wait for a token until
+// they are stopped. A perSecond of zero or less removes the limit, which is the
+// default.
+func SetGlobalRestartRate(perSecond float64, burst int) {
+	globalLimiterM.Lock()
+	defer globalLimiterM.Unlock()
+	if perSecond <= 0 {
+		globalLimiter = nil
+	} else {
+		globalLimiter = newTokenBucket(perSecond, burst)
+	}
+}
+
+// getGlobalLimiter returns the limiter configured with SetGlobalRestartRate, or
+// nil if there is none.
+func getGlobalLimiter() *tokenBucket {
+	globalLimiterM.Lock()
+	defer globalLimiterM.Unlock()
+	return globalLimiter
+}
+
+// tokenBucket is a token bucket rate limiter that can be shared by several
+// supervisors to throttle their restarts. It's driven by the clock of the
+// supervisor using it, see WithClock.
+type tokenBucket struct {
+	m      sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // maximum number of tokens in the bucket
+	tokens float64
+	last   time.Time // zero until the bucket is first used
+}
+
+func newTokenBucket(perSecond float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   perSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// advance refills the bucket with the tokens accumulated since the last call,
+// as of now. The caller must hold b.m.
+func (b *tokenBucket) advance(now time.Time) {
+	if elapsed := now.Sub(b.last); !b.last.IsZero() && elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// reserve debits n tokens from the bucket at now and returns how long the
+// caller has to wait before the debit is covered. The bucket is allowed to go
+// into debt, so a reservation larger than the bucket's capacity simply waits
+// longer rather than never being satisfied. Reserving no tokens never waits.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.advance(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns n previously reserved tokens to the bucket at now.
+func (b *tokenBucket) cancel(n int, now time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.advance(now)
+	b.tokens = math.Min(b.burst, b.tokens+float64(n))
+}
+
+// wait blocks on clock until n tokens have been acquired or stop is closed,
+// and reports whether the tokens were acquired.
+func (b *tokenBucket) wait(n int, stop <-chan struct{}, clock Clock) bool {
+	d := b.reserve(n, clock.Now())
+	if d <= 0 {
+		return true
+	}
+	t := clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-stop:
+		b.cancel(n, clock.Now())
+		return false
+	}
+}
+
+// Semaphore is a weighted semaphore, such as *semaphore.Weighted from
+// golang.org/x/sync/semaphore, used to gate restarts with WithRestartSemaphore.
+type Semaphore interface {
+	// Acquire blocks until n units are acquired or ctx is done, in which case
+	// it returns ctx.Err().
+	Acquire(ctx context.Context, n int64) error
+	// Release releases n units.
+	Release(n int64)
+}
+
+// acquireRestart acquires the semaphore configured with WithRestartSemaphore,
+// if any, holding it until the next invocation starts. It returns false if
+// stop is closed while waiting.
+func (s *Supervisor) acquireRestart(stop <-chan struct{}) bool {
+	if s.opts.semaphore == nil {
+		return true
+	}
+	if s.opts.semaphore.Acquire(stopContext{stop}, s.opts.semaphoreWeight) != nil {
+		return false
+	}
+	s.m.Lock()
+	s.semaphoreHeld = true
+	s.m.Unlock()
+	return true
+}
+
+// stopContext is a context that is cancelled once stop is closed, which lets
+// a Semaphore be interrupted by stop without a go-routine watching it.
+type stopContext struct {
+	stop <-chan struct{}
+}
+
+func (stopContext) Deadline() (time.Time, bool)   { return time.Time{}, false }
+func (c stopContext) Done() <-chan struct{}       { return c.stop }
+func (stopContext) Value(interface{}) interface{} { return nil }
+
+func (c stopContext) Err() error {
+	select {
+	case <-c.stop:
+		return context.Canceled
+	default:
+		return nil
+	}
+}
+
+// releaseRestart releases the semaphore if it's held.
+func (s *Supervisor) releaseRestart() {
+	s.m.Lock()
+	held := s.semaphoreHeld
+	s.semaphoreHeld = false
+	s.m.Unlock()
+	if held {
+		s.opts.semaphore.Release(s.opts.semaphoreWeight)
+	}
+}
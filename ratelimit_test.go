@@ -0,0 +1,136 @@
+package reroutine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("Reserve", func(t *testing.T) {
+		b := newTokenBucket(10, 2)
+		now := time.Now()
+		if d := b.reserve(2, now); d != 0 {
+			t.Errorf("expected burst to be available, got %v", d)
+		}
+		if d := b.reserve(1, now); d != 100*time.Millisecond {
+			t.Errorf("expected to wait 100ms, got %v", d)
+		}
+		if d := b.reserve(0, now); d != 0 {
+			t.Errorf("expected a zero reservation not to wait while in debt, got %v", d)
+		}
+	})
+	t.Run("Cost exceeds burst", func(t *testing.T) {
+		b := newTokenBucket(1000, 1)
+		if !b.wait(5, nil, realClock{}) {
+			t.Error("expected tokens to be acquired")
+		}
+	})
+	t.Run("Stop", func(t *testing.T) {
+		b := newTokenBucket(1, 1)
+		b.reserve(1, time.Now())
+		stop := make(chan struct{})
+		close(stop)
+		if b.wait(1, stop, realClock{}) {
+			t.Error("expected wait to be interrupted")
+		}
+	})
+	t.Run("Clock", func(t *testing.T) {
+		clock := newFakeClock()
+		b := newTokenBucket(1, 1)
+		b.reserve(1, clock.Now())
+		acquired := make(chan bool)
+		go func() {
+			acquired <- b.wait(1, nil, clock)
+		}()
+		<-clock.added
+		clock.Advance(time.Second)
+		if !<-acquired {
+			t.Error("expected the fake clock to refill the bucket")
+		}
+	})
+}
+
+func TestGlobalRestartRate(t *testing.T) {
+	SetGlobalRestartRate(20, 1)
+	defer SetGlobalRestartRate(0, 0)
+
+	// Two supervisors restarting twice each need four tokens, three of
+	// which have to be refilled at one every 50ms.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			BlockingGo(nil, func() {
+				panic("panicked")
+			}, WithMaxRestarts(2))
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected restarts to be throttled globally, took %v", elapsed)
+	}
+	if getGlobalLimiter() == nil {
+		t.Error("expected a global limiter")
+	}
+}
+
+// chanSemaphore is a Semaphore of n units, each taken by sending to a channel.
+type chanSemaphore chan struct{}
+
+func (sem chanSemaphore) Acquire(ctx context.Context, n int64) error {
+	for i := int64(0); i < n; i++ {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			sem.Release(i)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (sem chanSemaphore) Release(n int64) {
+	for i := int64(0); i < n; i++ {
+		<-sem
+	}
+}
+
+func TestRestartSemaphore(t *testing.T) {
+	captureLogs(t)
+	sem := make(chanSemaphore, 1)
+	sem.Acquire(context.Background(), 1)
+	var i int32
+	h := Go(nil, func() {
+		if atomic.AddInt32(&i, 1) == 1 {
+			panic("panicked")
+		}
+		select {}
+	}, WithRestartSemaphore(sem, 1))
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&i); n != 1 {
+		t.Fatalf("expected the restart to wait for the semaphore, got %d invocations", n)
+	}
+	sem.Release(1)
+	for atomic.LoadInt32(&i) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := sem.Acquire(timeout(t, time.Second), 1); err != nil {
+		t.Fatalf("expected the semaphore to be released once the worker started, got %v", err)
+	}
+	h.Stop()
+	h.Wait()
+
+	h = Go(nil, func() {
+		panic("panicked")
+	}, WithRestartSemaphore(sem, 1))
+	<-h.Started()
+	h.Stop()
+	if err := h.WaitContext(timeout(t, time.Second)); err != nil {
+		t.Errorf("expected stopping to abandon acquiring the semaphore, got %v", err)
+	}
+}
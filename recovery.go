@@ -0,0 +1,132 @@
+package reroutine
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// GroupWithRecoveryOrder orders restarts by priority, highest first, and lets
+// at most parallel of them proceed at the same time, so that a group recovering
+// from a correlated failure brings its critical members back first without
+// restarting them all at once. priority is called with the name given to each
+// member with Group.GoNamed or WithName. A restart holds one of the parallel
+// slots from when it's done backing off until the restarted invocation has
+// begun; restarts waiting for a slot get it in priority order, and in the
+// order they started waiting when priorities are equal. Like WithRestartRate,
+// the slots are created when GroupWithRecoveryOrder is called, so every
+// supervisor the Option is passed to, including every member of a Group,
+// shares them. A parallel of less than one is treated as one.
+func GroupWithRecoveryOrder(priority func(name string) int, parallel int) Option {
+	if parallel < 1 {
+		parallel = 1
+	}
+	gate := &recoveryGate{parallel: parallel}
+	return func(o *options) {
+		o.recovery = gate
+		o.recoveryPriority = priority
+	}
+}
+
+// recoveryGate hands out a fixed number of restart slots in priority order.
+type recoveryGate struct {
+	m        sync.Mutex
+	parallel int
+	inFlight int
+	seq      int
+	waiters  []*recoveryWaiter // ordered by priority, then seq
+}
+
+type recoveryWaiter struct {
+	priority int
+	seq      int
+	ready    chan struct{}
+}
+
+func (g *recoveryGate) acquire(ctx context.Context, priority int) error {
+	g.m.Lock()
+	if g.inFlight < g.parallel && len(g.waiters) == 0 {
+		g.inFlight++
+		g.m.Unlock()
+		return nil
+	}
+	g.seq++
+	w := &recoveryWaiter{priority: priority, seq: g.seq, ready: make(chan struct{})}
+	i := sort.Search(len(g.waiters), func(i int) bool {
+		return g.waiters[i].priority < priority
+	})
+	g.waiters = append(g.waiters, nil)
+	copy(g.waiters[i+1:], g.waiters[i:])
+	g.waiters[i] = w
+	g.m.Unlock()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	g.m.Lock()
+	for i, other := range g.waiters {
+		if other == w {
+			g.waiters = append(g.waiters[:i], g.waiters[i+1:]...)
+			g.m.Unlock()
+			return ctx.Err()
+		}
+	}
+	g.m.Unlock()
+	// The slot was handed over while giving up, so pass it on.
+	g.release()
+	return ctx.Err()
+}
+
+func (g *recoveryGate) release() {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if len(g.waiters) == 0 {
+		g.inFlight--
+		return
+	}
+	w := g.waiters[0]
+	g.waiters = g.waiters[1:]
+	close(w.ready)
+}
+
+// recoverySlot is the Semaphore through which a supervisor with the given
+// priority takes slots of a recoveryGate. The weight is ignored, as every
+// restart takes a single slot.
+type recoverySlot struct {
+	gate     *recoveryGate
+	priority int
+}
+
+func (s recoverySlot) Acquire(ctx context.Context, _ int64) error {
+	return s.gate.acquire(ctx, s.priority)
+}
+
+func (s recoverySlot) Release(int64) {
+	s.gate.release()
+}
+
+// chainedSemaphore acquires first, n units of it, and then then, one unit of
+// it, for supervisors that combine WithRestartSemaphore and
+// GroupWithRecoveryOrder.
+type chainedSemaphore struct {
+	first Semaphore
+	n     int64
+	then  Semaphore
+}
+
+func (c chainedSemaphore) Acquire(ctx context.Context, _ int64) error {
+	if err := c.first.Acquire(ctx, c.n); err != nil {
+		return err
+	}
+	if err := c.then.Acquire(ctx, 1); err != nil {
+		c.first.Release(c.n)
+		return err
+	}
+	return nil
+}
+
+func (c chainedSemaphore) Release(int64) {
+	c.then.Release(1)
+	c.first.Release(c.n)
+}
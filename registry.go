@@ -0,0 +1,134 @@
+package reroutine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The registry of live supervisors, which is only maintained once
+// EnableRegistry has been called.
+var (
+	registryM       sync.Mutex
+	registryEnabled bool
+	registry        map[*Supervisor]struct{}
+)
+
+// SupervisorInfo describes a live supervisor, as returned by Snapshot.
+type SupervisorInfo struct {
+	// Name is the name configured with WithName, if any.
+	Name string
+	// State is "running" while an invocation of the worker is running, and
+	// "backing off" while the supervisor waits to restart it.
+	State string
+	// Restarts is the number of times the worker has been restarted.
+	Restarts int
+	// LastPanic is the value recovered from the most recent panic, if any.
+	LastPanic interface{}
+	// Started is when the first invocation of the worker was launched.
+	Started time.Time
+}
+
+// EnableRegistry starts tracking supervisors so that they can be listed with
+// Snapshot, which is useful for debug endpoints. Only supervisors that start
+// after EnableRegistry is called are tracked. Supervisors are removed from the
+// registry once supervision ends, so that it never retains them.
+func EnableRegistry() {
+	registryM.Lock()
+	defer registryM.Unlock()
+	if !registryEnabled {
+		registryEnabled = true
+		registry = make(map[*Supervisor]struct{})
+	}
+}
+
+// Snapshot describes every live supervisor tracked since EnableRegistry was
+// called, ordered by when they started. It returns nil if there are none,
+// which is always the case if the registry isn't enabled.
+func Snapshot() []SupervisorInfo {
+	registryM.Lock()
+	supervisors := make([]*Supervisor, 0, len(registry))
+	for s := range registry {
+		supervisors = append(supervisors, s)
+	}
+	registryM.Unlock()
+	if len(supervisors) == 0 {
+		return nil
+	}
+	infos := make([]SupervisorInfo, 0, len(supervisors))
+	for _, s := range supervisors {
+		infos = append(infos, s.info())
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// waitAllInterval is how often WaitAll checks the registry.
+const waitAllInterval = time.Millisecond
+
+// WaitAll blocks until every supervisor tracked since EnableRegistry was called
+// has ended, or until ctx is done, in which case it returns an error wrapping
+// ctx.Err() that lists the names of the supervisors still running. It's meant
+// for process shutdown, once everything has been told to stop. Supervisors
+// aren't tracked unless the registry is enabled, so WaitAll returns straight
+// away if it isn't.
+func WaitAll(ctx context.Context) error {
+	ticker := time.NewTicker(waitAllInterval)
+	defer ticker.Stop()
+	for {
+		infos := Snapshot()
+		if len(infos) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			names := make([]string, len(infos))
+			for i, info := range infos {
+				names[i] = info.Name
+				if names[i] == "" {
+					names[i] = "unnamed"
+				}
+			}
+			return fmt.Errorf("reroutine: wait all: %d supervisors still running (%s): %w", len(infos), strings.Join(names, ", "), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// register adds s to the registry, if it's enabled.
+func register(s *Supervisor) {
+	registryM.Lock()
+	defer registryM.Unlock()
+	if registryEnabled {
+		registry[s] = struct{}{}
+	}
+}
+
+// deregister removes s from the registry.
+func deregister(s *Supervisor) {
+	registryM.Lock()
+	defer registryM.Unlock()
+	delete(registry, s)
+}
+
+// info describes the supervisor for Snapshot.
+func (s *Supervisor) info() SupervisorInfo {
+	s.m.Lock()
+	defer s.m.Unlock()
+	state := "running"
+	if s.backingOff {
+		state = "backing off"
+	}
+	return SupervisorInfo{
+		Name:      s.opts.name,
+		State:     state,
+		Restarts:  s.restarts,
+		LastPanic: s.lastPanic,
+		Started:   s.begin,
+	}
+}
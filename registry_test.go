@@ -0,0 +1,80 @@
+package reroutine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	captureLogs(t)
+	EnableRegistry()
+
+	stop := make(chan struct{})
+	i := 0
+	h := Go(stop, func() {
+		if i++; i < 3 {
+			panic("panicked")
+		}
+		<-stop
+	}, WithName("worker"))
+	backingOff := Go(stop, func() {
+		panic("backing off")
+	}, WithName("backing off"), WithBackoff(time.Hour, 0))
+
+	deadline := time.Now().Add(time.Second)
+	var infos map[string]SupervisorInfo
+	for time.Now().Before(deadline) {
+		infos = named(Snapshot())
+		if len(infos) == 2 && infos["worker"].Restarts == 2 && infos["backing off"].State == "backing off" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if worker := infos["worker"]; worker.State != "running" || worker.Restarts != 2 || worker.LastPanic != "panicked" {
+		t.Errorf("unexpected worker info %+v", worker)
+	}
+	if info := infos["backing off"]; info.State != "backing off" || info.LastPanic != "backing off" {
+		t.Errorf("unexpected backing off info %+v", info)
+	}
+
+	close(stop)
+	h.Wait()
+	backingOff.Wait()
+	if infos := named(Snapshot()); len(infos) != 0 {
+		t.Errorf("expected stopped supervisors to be removed, got %+v", infos)
+	}
+}
+
+func TestWaitAll(t *testing.T) {
+	EnableRegistry()
+	stop := make(chan struct{})
+	h := Go(stop, func() {
+		<-stop
+	}, WithName("worker"))
+	err := WaitAll(timeout(t, 10*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "worker") {
+		t.Errorf("expected the running worker to be listed, got %v", err)
+	}
+
+	close(stop)
+	if err := WaitAll(timeout(t, time.Second)); err != nil {
+		t.Error(err)
+	}
+	if h.Reason() == StopReasonNone {
+		h.Wait()
+	}
+}
+
+// named indexes infos by name, dropping supervisors without one.
+func named(infos []SupervisorInfo) map[string]SupervisorInfo {
+	m := make(map[string]SupervisorInfo)
+	for _, info := range infos {
+		if info.Name != "" {
+			m[info.Name] = info
+		}
+	}
+	return m
+}
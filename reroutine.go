@@ -1,36 +1,312 @@
 package reroutine
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // Go starts the function do in a go-routine and restarts it only if it panics
 // until the stop channel is closed. If the go-routine returns without panic,
-// then it is not restarted. This function returns immediately.
-func Go(stopChan <-chan struct{}, do func()) {
-	go BlockingGo(stopChan, do)
+// then it is not restarted. This function returns immediately with a Handle
+// that can also be used to stop the go-routine and wait for it.
+//
+// A nil stop channel is never closed, so the go-routine is restarted until it
+// returns without panicking, the supervisor gives up, or Handle.Stop is called.
+// The same goes for every other function that accepts a stop channel.
+func Go(stopChan <-chan struct{}, do func(), opts ...Option) *Handle {
+	s := NewSupervisor(do, opts...)
+	return start(stopChan, s, s.Run)
+}
+
+// GoForever is the same as Go without a stop channel, making it explicit that
+// the go-routine is only stopped by calling Handle.Stop, by returning without
+// panicking, or by the supervisor giving up, for example because of
+// WithMaxRestarts.
+func GoForever(do func(), opts ...Option) *Handle {
+	return Go(nil, do, opts...)
 }
 
 // BlockingGo is the same as Go but does not return until the provided function
 // returns without panicking or the context is cancelled.
-func BlockingGo(stopChan <-chan struct{}, do func()) {
-	start := make(chan struct{})
-	go func() {
-		start <- struct{}{}
-	}()
-	for {
-		select {
-		case <-stopChan:
-			return
-		case _, ok := <-start:
-			if !ok {
-				return
+//
+// Each invocation still runs on a go-routine of its own, unless WithInline is
+// used, so values that tracing or deadline libraries keep per go-routine
+// aren't visible to the worker. WithGoroutineWrapper is called on the
+// go-routine that called BlockingGo, which lets it copy those values across.
+func BlockingGo(stopChan <-chan struct{}, do func(), opts ...Option) {
+	NewSupervisor(do, opts...).Run(stopChan)
+}
+
+// GoDone is like Go except that instead of returning a Handle, it calls done
+// exactly once when supervision has ended for any reason, including after the
+// supervisor gave up on a panic. done runs after the finalizer configured with
+// WithFinalizer, if any, and a panic in done is logged rather than restarted.
+func GoDone(stopChan <-chan struct{}, do func(), done func(), opts ...Option) {
+	spawn(func() {
+		defer callback("done callback", done)
+		BlockingGo(stopChan, do, opts...)
+	})
+}
+
+// ExitCode is the value that GoExitCode passes to WithRestartIf, WithOnRestart
+// and WithRestartHook instead of a recovered panic value when the worker is
+// restarted because of the code it returned.
+type ExitCode int
+
+func (c ExitCode) String() string {
+	return fmt.Sprintf("exit code %d", int(c))
+}
+
+// GoExitCode is like Go for a worker that reports how it ended with an exit
+// code, such as one that wraps an external process. When do returns, it is
+// restarted if shouldRestart returns true for the code, subject to the same
+// options as a panic, such as WithBackoff and WithMaxRestarts. Otherwise it's
+// treated as a clean exit. Panics are restarted as usual.
+func GoExitCode(stopChan <-chan struct{}, shouldRestart func(code int) bool, do func() int, opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	var code int
+	s.do = func(int) {
+		code = do()
+	}
+	s.returned = func() (interface{}, bool) {
+		return ExitCode(code), shouldRestart(code)
+	}
+	return start(stopChan, s, s.Run)
+}
+
+// GoPoll is like Go for a poller: do is called again every time it returns
+// having done some work, and supervision only ends once do has returned
+// maxIdle times in a row without doing any work, or once stopped. A maxIdle of
+// zero or less means it never ends for being idle. Calling do again is not a
+// restart, so it isn't logged, delayed or limited by options like WithBackoff
+// and WithMaxRestarts, which only apply to panics. The idle count is reset
+// after a panic. do is expected to wait for work itself, since an idle
+// iteration is followed by the next one straight away.
+func GoPoll(stopChan <-chan struct{}, maxIdle int, do func() (didWork bool), opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	return start(stopChan, s, func(stop <-chan struct{}) {
+		s.run(stop, func(int) {
+			for idle := 0; maxIdle <= 0 || idle < maxIdle; {
+				if do() {
+					idle = 0
+				} else {
+					idle++
+				}
+				select {
+				case <-stop:
+					s.setReason(StopReasonStopped)
+					return
+				default:
+				}
 			}
-			go func() {
-				defer HandleCrash(func(_ interface{}) {
-					start <- struct{}{}
-				})
-				do()
-				close(start)
+		})
+	})
+}
+
+// GoDrain is like Go except that do is passed two signals: drain, which asks
+// it to stop taking on new work but to finish what it has, and stop, which is
+// closed when the stop channel is closed or Handle.Stop is called and asks it
+// to return as soon as possible. Returning without panicking ends supervision
+// as usual, so a worker that returns once drained is not restarted:
+//
+//	reroutine.GoDrain(drain, stop, func(drain, stop <-chan struct{}) {
+//		for {
+//			select {
+//			case <-drain:
+//				return
+//			case <-stop:
+//				return
+//			case item := <-queue:
+//				process(item)
+//			}
+//		}
+//	})
+//
+// A worker that is restarted after a panic while draining is restarted with
+// drain already closed, so it should return promptly.
+func GoDrain(drain, stopChan <-chan struct{}, do func(drain, stop <-chan struct{}), opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	return start(stopChan, s, func(stop <-chan struct{}) {
+		s.run(stop, func(int) {
+			do(drain, stop)
+		})
+	})
+}
+
+// GoCleanup is like Go for a worker that sets up resources it must release
+// once each invocation ends. do is passed cleanup, which registers a function to
+// call when the invocation ends, whether do returns or panics, before the
+// supervisor decides whether to restart it. The functions registered by an
+// invocation are called in the reverse order they were registered in, as
+// deferred calls are, and a panic in one of them is logged rather than
+// restarted:
+//
+//	reroutine.GoCleanup(stop, func(cleanup func(func())) {
+//		conn := dial()
+//		cleanup(conn.Close)
+//		serve(conn)
+//	})
+func GoCleanup(stopChan <-chan struct{}, do func(cleanup func(fn func())), opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	return start(stopChan, s, func(stop <-chan struct{}) {
+		s.run(stop, func(int) {
+			var m sync.Mutex
+			var cleanups []func()
+			defer func() {
+				m.Lock()
+				defer m.Unlock()
+				for i := len(cleanups) - 1; i >= 0; i-- {
+					callback("cleanup", cleanups[i])
+				}
 			}()
+			do(func(fn func()) {
+				m.Lock()
+				defer m.Unlock()
+				cleanups = append(cleanups, fn)
+			})
+		})
+	})
+}
+
+// GoInline is like Go except that the first invocation of do runs on the
+// calling go-routine, so GoInline does not return until it has either returned
+// or panicked. Only if it panicked is do restarted in the background. This is
+// useful for initialization that should complete before the caller proceeds
+// but should heal itself if it fails. If the supervisor decides not to restart
+// after the first panic, the returned Handle has already stopped.
+func GoInline(stopChan <-chan struct{}, do func(), opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	s.begin = s.opts.clock.Now()
+	// Through the same path as the restarts, so that the go-routine wrapper
+	// and WithSingleFlight apply to the first invocation too.
+	o, ok := s.invokeInline(stopChan, 1, func(int) {
+		do()
+	})
+	return start(stopChan, s, func(stop <-chan struct{}) {
+		if !ok {
+			// Stopped while waiting for a previous invocation to return.
+			s.setReason(StopReasonStopped)
+		}
+		if !o.restart {
+			s.finalize()
+			return
 		}
+		s.resume(stop, 2, o.delay, func(int) {
+			do()
+		})
+	})
+}
+
+// GoContext is like Go except that it stops restarting do once ctx is done.
+// Each invocation of do receives a context derived from ctx that carries the
+// current attempt, which can be retrieved with AttemptFromContext. The panic
+// handlers carried by ctx, see WithPanicHandlers, are run for its panics.
+func GoContext(ctx context.Context, do func(ctx context.Context), opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	return start(ctx.Done(), s, func(stop <-chan struct{}) {
+		s.runContext(ctx, stop, do)
+	})
+}
+
+// BlockingGoContext is the same as GoContext but does not return until the
+// provided function returns without panicking or the context is cancelled.
+func BlockingGoContext(ctx context.Context, do func(ctx context.Context), opts ...Option) {
+	newSupervisor(opts).runContext(ctx, ctx.Done(), do)
+}
+
+// runContext supervises do like BlockingGoContext until stop is closed.
+func (s *Supervisor) runContext(ctx context.Context, stop <-chan struct{}, do func(ctx context.Context)) {
+	s.ctxHandlers = ContextPanicHandlers(ctx)
+	s.run(stop, func(attempt int) {
+		ctx, cancel := s.invocationContext(ctx)
+		defer cancel()
+		do(context.WithValue(ctx, attemptKey{}, attempt))
+	})
+}
+
+type attemptKey struct{}
+
+// AttemptFromContext returns the attempt of the invocation that received ctx,
+// starting at one for the first invocation. It returns one if ctx was not
+// provided by one of the context variants.
+func AttemptFromContext(ctx context.Context) int {
+	if attempt, ok := ctx.Value(attemptKey{}).(int); ok {
+		return attempt
 	}
+	return 1
+}
+
+// RunOnce returns a function that supervises do in the same way as BlockingGo
+// except that once do has returned without panicking, it is never run again.
+// Calling the returned function after a clean completion returns immediately,
+// while calling it after supervision ended for any other reason (the stop
+// channel was closed or the restarts were exhausted) supervises do again.
+// Invocations of do never overlap, even when an earlier invocation was left
+// running after the stop channel was closed.
+func RunOnce(stopChan <-chan struct{}, do func(), opts ...Option) func() {
+	var m sync.Mutex
+	var done int32
+	once := func() {
+		m.Lock()
+		defer m.Unlock()
+		if atomic.LoadInt32(&done) == 1 {
+			return
+		}
+		do()
+		atomic.StoreInt32(&done, 1)
+	}
+	return func() {
+		if atomic.LoadInt32(&done) == 1 {
+			return
+		}
+		BlockingGo(stopChan, once, opts...)
+	}
+}
+
+// RunBestEffort runs do once on the calling go-routine. If do panics, the panic
+// is logged and passed to the PanicHandlers, and RunBestEffort returns as if do
+// had returned. do is never restarted and, unlike HandleCrash, the panic is
+// never re-raised, even when ReallyCrash is set. Use `go RunBestEffort(do)` to
+// fire and forget a background task.
+func RunBestEffort(do func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			runHandlers(r, nil, nil)
+		}
+	}()
+	do()
+}
+
+// Guard runs fn once on the calling go-routine and, if it panics, recovers the
+// panic, passes a description of it to report, if not nil, and returns as if
+// fn had returned. Unlike RunBestEffort, it doesn't log the panic, run the
+// PanicHandlers or read any other package setting, so it's suited for
+// libraries that invoke callbacks and must never let their panics escape to
+// their own callers. PanicInfo.Attempt is always one, and the fields that
+// describe supervisors, such as Name, are left empty. A panic in report isn't
+// recovered.
+func Guard(fn func(), report func(PanicInfo)) {
+	defer func() {
+		if r := recover(); r != nil {
+			frames, panics := captureFrames()
+			info := PanicInfo{
+				Value:   r,
+				Stack:   captureStack(),
+				Frames:  frames,
+				Panics:  panics,
+				Attempt: 1,
+				Time:    time.Now(),
+			}
+			info.Goroutine = goroutineID(info.Stack)
+			if report != nil {
+				report(info)
+			}
+		}
+	}()
+	fn()
 }
 
 // Tomb is the minimum required interface to operate reroutine against a Tomb instance
@@ -41,33 +317,122 @@ type Tomb interface {
 	Go(func() error)
 }
 
+// Killer is an optional interface of a Tomb that can be killed directly, as
+// tomb.Tomb can. When the supervisor gives up on a panic, it kills a Killer
+// with the error describing the panic straight away, rather than only
+// returning the error from the function passed to Go, which not every tomb
+// kills itself with.
+type Killer interface {
+	// Kill puts the tomb in a dying state for the given reason.
+	Kill(reason error)
+}
+
+// ErrReporter is an optional interface of a Tomb that reports why it was
+// killed, as tomb.Tomb does. When supervision ends because such a tomb is
+// dying, the supervisor records the reason, which the function returned by
+// GoTombValue then reports.
+type ErrReporter interface {
+	// Err returns the reason the tomb was killed.
+	Err() error
+}
+
+// tombCapabilities returns the optional interfaces implemented by ts, or by
+// the tomb it wraps.
+func tombCapabilities(ts Tomb) (Killer, ErrReporter) {
+	if vt, ok := ts.(valueTomb); ok {
+		ts = vt.Tomb
+	}
+	killer, _ := ts.(Killer)
+	reporter, _ := ts.(ErrReporter)
+	return killer, reporter
+}
+
+// checkTomb panics if ts is nil, which unlike a nil stop channel has no
+// sensible meaning, so that the mistake is reported where it was made rather
+// than from the supervising go-routine.
+func checkTomb(ts Tomb) {
+	if ts == nil {
+		panic("reroutine: nil Tomb")
+	}
+}
+
 // GoTomb is similar to Go except that it operates using a tomb.Tomb instance instead of
-// a context.
-func GoTomb(ts Tomb, do func() error) {
-	go BlockingGoTomb(ts, do)
+// a context. It panics if ts is nil.
+func GoTomb(ts Tomb, do func() error, opts ...Option) {
+	checkTomb(ts)
+	spawn(func() {
+		BlockingGoTomb(ts, do, opts...)
+	})
 }
 
 // BlockingGoTomb is like GoTomb but does not return until the provided function
-// returns without panicking or the context is cancelled.
-func BlockingGoTomb(ts Tomb, do func() error) {
-	start := make(chan struct{})
-	go func() {
-		start <- struct{}{}
-	}()
-	for _ = range start {
-		select {
-		case <-ts.Dying():
-			return
-		default:
-		}
-		ts.Go(func() error {
-			defer HandleCrash(func(_ interface{}) {
-				start <- struct{}{}
-			})
-			err := do()
-			// Function completed without panic, don't restart
-			close(start)
-			return err
+// returns without panicking or the context is cancelled. If the supervisor gives
+// up on a panic, the tomb is killed with an error describing it: a
+// *MaxRestartsError or *BudgetExceededError when the supervisor gave up for
+// those reasons, or a *PanicError otherwise. All of them can be unwrapped to a
+// *PanicError with errors.As.
+func BlockingGoTomb(ts Tomb, do func() error, opts ...Option) {
+	checkTomb(ts)
+	newSupervisor(opts).runTomb(ts, func(int) error {
+		return do()
+	})
+}
+
+// GoTombValue is like GoTomb for a worker that produces a value. The returned
+// function reports the outcome of supervision:
+// the value and error returned by do once it has returned without panicking,
+// or the zero value and the error the tomb was killed with once the supervisor
+// has given up on a panic. If supervision ends because the tomb is dying and
+// the tomb implements ErrReporter, it reports the zero value and the reason
+// the tomb was killed, if not nil, falling back to ErrStopped with
+// WithStopIsError. Until then, it reports the zero value and a nil error. The
+// value is read under a mutex, so the function is safe to call
+// from any go-routine.
+func GoTombValue[T any](ts Tomb, do func() (T, error), opts ...Option) func() (T, error) {
+	checkTomb(ts)
+	var m sync.Mutex
+	var value T
+	var err error
+	vt := valueTomb{Tomb: ts, done: func(e error) {
+		m.Lock()
+		defer m.Unlock()
+		err = e
+	}}
+	s := newSupervisor(opts)
+	spawn(func() {
+		s.runTomb(vt, func(int) error {
+			v, e := do()
+			m.Lock()
+			value = v
+			m.Unlock()
+			return e
 		})
+		if s.Reason() == StopReasonStopped {
+			if e := s.Err(); e != nil {
+				m.Lock()
+				err = e
+				m.Unlock()
+			}
+		}
+	})
+	return func() (T, error) {
+		m.Lock()
+		defer m.Unlock()
+		return value, err
 	}
 }
+
+// valueTomb is a Tomb that calls done with the error returned by each function
+// it runs.
+type valueTomb struct {
+	Tomb
+	done func(err error)
+}
+
+func (t valueTomb) Go(f func() error) {
+	t.Tomb.Go(func() error {
+		err := f()
+		t.done(err)
+		return err
+	})
+}
@@ -1,11 +1,18 @@
 package reroutine
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime"
+	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGo(t *testing.T) {
@@ -36,6 +43,98 @@ func TestGo(t *testing.T) {
 		})
 	})
 
+	t.Run("Stop during backoff", func(t *testing.T) {
+		stop := make(chan struct{})
+		start := time.Now()
+		BlockingGo(stop, func() {
+			close(stop)
+			panic("panicked")
+		}, WithBackoff(time.Hour, 0))
+		if time.Since(start) > time.Second {
+			t.Error("expected stop to interrupt the backoff")
+		}
+	})
+
+	t.Run("Max restarts", func(t *testing.T) {
+		i := int32(0)
+		BlockingGo(make(chan struct{}), func() {
+			atomic.AddInt32(&i, 1)
+			panic("panicked")
+		}, WithMaxRestarts(2))
+		if atomic.LoadInt32(&i) != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+
+	t.Run("Restart if", func(t *testing.T) {
+		i := int32(0)
+		BlockingGo(make(chan struct{}), func() {
+			panic(atomic.AddInt32(&i, 1))
+		}, WithRestartIf(func(r interface{}) bool {
+			return r.(int32) < 3
+		}))
+		if atomic.LoadInt32(&i) != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+
+	t.Run("Run once", func(t *testing.T) {
+		i := int32(0)
+		run := RunOnce(make(chan struct{}), func() {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+		})
+		run()
+		run()
+		if atomic.LoadInt32(&i) != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		t.Run("Blocking", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var attempts []int
+			BlockingGoContext(ctx, func(ctx context.Context) {
+				attempts = append(attempts, AttemptFromContext(ctx))
+				if len(attempts) < 3 {
+					panic("panicked")
+				}
+			})
+			if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+				t.Errorf("expected attempts 1 through 3, got %v", attempts)
+			}
+		})
+		t.Run("Cancel", func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			i := int32(0)
+			BlockingGoContext(ctx, func(context.Context) {
+				if atomic.AddInt32(&i, 1) == 3 {
+					cancel()
+				}
+				panic("panicked")
+			})
+			if atomic.LoadInt32(&i) != 3 {
+				t.Error("expected three iterations")
+			}
+		})
+		t.Run("Async", func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			GoContext(context.Background(), func(context.Context) {
+				wg.Done()
+			})
+			wg.Wait()
+		})
+		t.Run("Default attempt", func(t *testing.T) {
+			if AttemptFromContext(context.Background()) != 1 {
+				t.Error("expected default attempt of one")
+			}
+		})
+	})
+
 	t.Run("Tomb", func(t *testing.T) {
 		t.Run("Blocking", func(t *testing.T) {
 			ts := mockTomb{}
@@ -52,12 +151,82 @@ func TestGo(t *testing.T) {
 					}
 					panic("panicked")
 				}
-				return nil
 			})
 			if atomic.LoadInt32(&i) != 3 {
 				t.Error("expected three iterations")
 			}
 		})
+		t.Run("Dying during backoff", func(t *testing.T) {
+			ts := mockTomb{}
+			ts.Go(func() error {
+				<-ts.Dying()
+				return nil
+			})
+
+			panicked := make(chan struct{})
+			go func() {
+				<-panicked
+				ts.Kill(nil)
+			}()
+			start := time.Now()
+			BlockingGoTomb(&ts, func() error {
+				panic("panicked")
+			}, WithBackoff(time.Hour, 0), WithOnPanic(func(PanicInfo) {
+				close(panicked)
+			}))
+			if time.Since(start) > time.Second {
+				t.Error("expected dying tomb to interrupt the backoff")
+			}
+		})
+		t.Run("Give up", func(t *testing.T) {
+			var ts mockTomb
+			ts.Go(func() error {
+				<-ts.Dying()
+				return nil
+			})
+			BlockingGoTomb(&ts, func() error {
+				panic("panicked")
+			}, WithMaxRestarts(1))
+			var panicErr *PanicError
+			if err := ts.Wait(); !errors.As(err, &panicErr) || panicErr.Value != "panicked" {
+				t.Errorf("expected tomb to be killed with the panic, got %v", err)
+			}
+		})
+		t.Run("Give up errors", func(t *testing.T) {
+			for _, tt := range []struct {
+				name   string
+				opts   []Option
+				target interface{}
+			}{
+				{"Max restarts", []Option{WithMaxRestarts(2)}, new(*MaxRestartsError)},
+				{"Budget exceeded", []Option{WithRetryBudget(10 * time.Millisecond), WithBackoff(time.Hour, 0)}, new(*BudgetExceededError)},
+				{"Predicate", []Option{WithRestartIf(func(interface{}) bool { return false })}, new(*PanicError)},
+			} {
+				var ts mockTomb
+				ts.Go(func() error {
+					<-ts.Dying()
+					return nil
+				})
+				BlockingGoTomb(&ts, func() error {
+					panic("panicked")
+				}, tt.opts...)
+				if err := ts.Wait(); !errors.As(err, tt.target) {
+					t.Errorf("%s: expected %T, got %v", tt.name, tt.target, err)
+				}
+			}
+			var ts mockTomb
+			ts.Go(func() error {
+				<-ts.Dying()
+				return nil
+			})
+			BlockingGoTomb(&ts, func() error {
+				panic("panicked")
+			}, WithMaxRestarts(2))
+			var maxErr *MaxRestartsError
+			if err := ts.Wait(); !errors.As(err, &maxErr) || maxErr.Attempts != 3 || maxErr.LastPanic != "panicked" {
+				t.Errorf("expected to give up after 3 attempts, got %v", err)
+			}
+		})
 		t.Run("Async", func(t *testing.T) {
 			var ts mockTomb
 			var wg sync.WaitGroup
@@ -238,3 +407,651 @@ func (t *mockTomb) Err() (reason error) {
 func (t *mockTomb) Alive() bool {
 	return t.Err() == ErrStillAlive
 }
+
+func TestGo_RecoverTransform(t *testing.T) {
+	type wrapped struct{ v interface{} }
+	var recovered interface{}
+	BlockingGo(make(chan struct{}), func() {
+		panic(wrapped{"panicked"})
+	}, WithMaxRestarts(0), WithRestartIf(func(r interface{}) bool {
+		recovered = r
+		return false
+	}), WithRecoverTransform(func(r interface{}) interface{} {
+		return r.(wrapped).v
+	}))
+	if recovered != "panicked" {
+		t.Errorf("expected unwrapped value, got %v", recovered)
+	}
+}
+
+func TestGo_GoroutineWrapper(t *testing.T) {
+	var wrapped, invocations int32
+	wrapper := WithGoroutineWrapper(func(f func()) func() {
+		return func() {
+			atomic.AddInt32(&wrapped, 1)
+			f()
+		}
+	})
+	BlockingGo(nil, func() {
+		if atomic.AddInt32(&invocations, 1) < 3 {
+			panic("panicked")
+		}
+	}, wrapper)
+	var ts mockTomb
+	BlockingGoTomb(&ts, func() error {
+		atomic.AddInt32(&invocations, 1)
+		return nil
+	}, wrapper)
+	if atomic.LoadInt32(&wrapped) != 4 || atomic.LoadInt32(&invocations) != 4 {
+		t.Errorf("expected every invocation to be wrapped, got %d of %d", wrapped, invocations)
+	}
+}
+
+func TestBlockingGo_GoroutineWrapper(t *testing.T) {
+	captureLogs(t)
+	// A stand-in for a library that keeps a value per go-routine.
+	var m sync.Mutex
+	local := make(map[int64]string)
+	current := func() int64 {
+		return goroutineID(captureStack())
+	}
+	m.Lock()
+	local[current()] = "deadline"
+	m.Unlock()
+
+	var seen []string
+	i := 0
+	BlockingGo(nil, func() {
+		m.Lock()
+		seen = append(seen, local[current()])
+		m.Unlock()
+		if i++; i == 1 {
+			panic("panicked")
+		}
+	}, WithGoroutineWrapper(func(f func()) func() {
+		m.Lock()
+		v := local[current()]
+		m.Unlock()
+		return func() {
+			id := current()
+			m.Lock()
+			local[id] = v
+			m.Unlock()
+			defer func() {
+				m.Lock()
+				delete(local, id)
+				m.Unlock()
+			}()
+			f()
+		}
+	}))
+	if len(seen) != 2 || seen[0] != "deadline" || seen[1] != "deadline" {
+		t.Errorf("expected the wrapper to copy the value into every invocation, got %q", seen)
+	}
+}
+
+func TestGo_Middleware(t *testing.T) {
+	captureLogs(t)
+	var calls []string
+	middleware := func(name string) func(func()) func() {
+		return func(next func()) func() {
+			return func() {
+				calls = append(calls, name+" before")
+				defer func() {
+					calls = append(calls, name+" after")
+				}()
+				next()
+			}
+		}
+	}
+	i := 0
+	BlockingGo(nil, func() {
+		calls = append(calls, "worker")
+		if i++; i == 1 {
+			panic("panicked")
+		}
+	}, WithMiddleware(middleware("outer")), WithMiddleware(middleware("inner")))
+	call := "outer before, inner before, worker, inner after, outer after"
+	if expected := call + ", " + call; strings.Join(calls, ", ") != expected {
+		t.Errorf("expected %q, got %q", expected, calls)
+	}
+}
+
+func TestGo_PprofLabels(t *testing.T) {
+	var dump bytes.Buffer
+	BlockingGo(nil, func() {
+		pprof.Lookup("goroutine").WriteTo(&dump, 1)
+	}, WithPprofLabels("reroutine", "labelled-worker"))
+	if !strings.Contains(dump.String(), `"reroutine":"labelled-worker"`) {
+		t.Errorf("expected the worker's go-routine to be labelled, got %s", dump.String())
+	}
+}
+
+func TestRunBestEffort(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(v bool) { ReallyCrash = v }(ReallyCrash)
+	ReallyCrash = true
+
+	i := 0
+	RunBestEffort(func() {
+		i++
+		panic("panicked")
+	})
+	if i != 1 {
+		t.Errorf("expected a single invocation, got %d", i)
+	}
+	if lines := logs(); len(lines) != 1 || !strings.Contains(lines[0], "panicked") {
+		t.Errorf("expected the panic to be logged, got %q", lines)
+	}
+}
+
+func TestGoContext_NoLeaks(t *testing.T) {
+	captureLogs(t)
+	defer func(v bool) { LogStackTrace = v }(LogStackTrace)
+	LogStackTrace = false
+
+	// Invocations are left running when the context is cancelled, so track
+	// them to wait for them before the logs are restored.
+	var workers sync.WaitGroup
+	executor := WithExecutor(ExecutorFunc(func(f func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			f()
+		}()
+	}))
+	before, active := runtime.NumGoroutine(), ActiveGoroutines()
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		jitter := func() time.Duration {
+			return time.Duration(rand.Intn(500)) * time.Microsecond
+		}
+		h := GoContext(ctx, func(ctx context.Context) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(jitter()):
+				panic("panicked")
+			}
+		}, WithBackoff(jitter(), time.Millisecond), WithRestartRate(1000, 1), WithOnStable(jitter(), func() {}), executor)
+		time.Sleep(jitter())
+		cancel()
+		h.Wait()
+	}
+	workers.Wait()
+	deadline := time.Now().Add(time.Second)
+	for (runtime.NumGoroutine() > before || ActiveGoroutines() > active) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := ActiveGoroutines(); n > active {
+		t.Errorf("expected %d active go-routines, got %d", active, n)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		buf := make([]byte, 1<<16)
+		t.Errorf("leaked %d go-routines:\n%s", n-before, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestGoTombValue(t *testing.T) {
+	t.Run("Clean", func(t *testing.T) {
+		var ts mockTomb
+		var i int32
+		finished := make(chan struct{})
+		ts.Go(func() error {
+			<-finished
+			return nil
+		})
+		result := GoTombValue(&ts, func() (int, error) {
+			if atomic.AddInt32(&i, 1) < 3 {
+				panic("panicked")
+			}
+			close(finished)
+			return 42, nil
+		})
+		if err := ts.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := result(); v != 42 || err != nil {
+			t.Errorf("expected the final value, got %v, %v", v, err)
+		}
+	})
+	t.Run("Give up", func(t *testing.T) {
+		var ts mockTomb
+		ts.Go(func() error {
+			<-ts.Dying()
+			return nil
+		})
+		result := GoTombValue(&ts, func() (string, error) {
+			panic("panicked")
+		}, WithMaxRestarts(1))
+		ts.Wait()
+		var maxErr *MaxRestartsError
+		if v, err := result(); v != "" || !errors.As(err, &maxErr) {
+			t.Errorf("expected the zero value and the give up error, got %q, %v", v, err)
+		}
+	})
+}
+
+// killerTomb is a Tomb that only implements Killer, and ignores the errors
+// returned by the functions it runs.
+type killerTomb struct {
+	killed chan error
+}
+
+func (killerTomb) Dying() <-chan struct{} { return nil }
+func (killerTomb) Go(f func() error)      { go f() }
+func (t killerTomb) Kill(reason error)    { t.killed <- reason }
+
+func TestGoTomb_Capabilities(t *testing.T) {
+	captureLogs(t)
+	t.Run("Minimal", func(t *testing.T) {
+		BlockingGoTomb(benchTomb{}, func() error {
+			panic("panicked")
+		}, WithMaxRestarts(1))
+	})
+	t.Run("Killer", func(t *testing.T) {
+		ts := killerTomb{killed: make(chan error, 1)}
+		BlockingGoTomb(ts, func() error {
+			panic("panicked")
+		}, WithMaxRestarts(1))
+		var maxErr *MaxRestartsError
+		if err := <-ts.killed; !errors.As(err, &maxErr) {
+			t.Errorf("expected the tomb to be killed with the give up error, got %v", err)
+		}
+	})
+	t.Run("ErrReporter", func(t *testing.T) {
+		var ts mockTomb
+		reason := errors.New("shutting down")
+		ts.Go(func() error {
+			<-ts.Dying()
+			return nil
+		})
+		started := make(chan struct{})
+		result := GoTombValue(&ts, func() (int, error) {
+			close(started)
+			<-ts.Dying()
+			panic("panicked")
+		})
+		<-started
+		ts.Kill(reason)
+		ts.Wait()
+		deadline := time.Now().Add(time.Second)
+		for _, err := result(); err == nil && time.Now().Before(deadline); _, err = result() {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := result(); err != reason {
+			t.Errorf("expected the reason the tomb was killed, got %v", err)
+		}
+	})
+}
+
+func TestGoCleanup(t *testing.T) {
+	captureLogs(t)
+	var events []string
+	i := 0
+	h := GoCleanup(nil, func(cleanup func(func())) {
+		i++
+		events = append(events, fmt.Sprintf("start %d", i))
+		n := i
+		cleanup(func() {
+			events = append(events, fmt.Sprintf("first cleanup %d", n))
+		})
+		cleanup(func() {
+			events = append(events, fmt.Sprintf("second cleanup %d", n))
+		})
+		if n == 1 {
+			panic("panicked")
+		}
+	}, WithBackoff(0, 0))
+	h.Wait()
+	expected := "start 1, second cleanup 1, first cleanup 1, start 2, second cleanup 2, first cleanup 2"
+	if got := strings.Join(events, ", "); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if h.Reason() != StopReasonClean || h.Restarts() != 1 {
+		t.Errorf("expected a clean exit after one restart, got %v after %d", h.Reason(), h.Restarts())
+	}
+}
+
+func TestGuard(t *testing.T) {
+	logs := captureLogs(t)
+	defer func(handlers []func(interface{})) { PanicHandlers = handlers }(PanicHandlers)
+	PanicHandlers = append(PanicHandlers, func(interface{}) {
+		t.Error("expected the global handlers not to run")
+	})
+	var reported []PanicInfo
+	report := func(info PanicInfo) {
+		reported = append(reported, info)
+	}
+	Guard(func() {}, report)
+	Guard(func() {
+		panic("panicked")
+	}, report)
+	Guard(func() {
+		panic("unreported")
+	}, nil)
+	if len(reported) != 1 {
+		t.Fatalf("expected one report, got %d", len(reported))
+	}
+	info := reported[0]
+	if info.Value != "panicked" || info.Attempt != 1 || info.Panics != 1 || len(info.Frames) == 0 || !bytes.Contains(info.Stack, []byte("TestGuard")) {
+		t.Errorf("expected the panic to be described, got %+v", info)
+	}
+	if lines := logs(); len(lines) != 0 {
+		t.Errorf("expected nothing to be logged, got %q", lines)
+	}
+}
+
+func TestGoDone(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		do   func()
+		opts []Option
+	}{
+		{"Clean", func() {}, nil},
+		{"Give up", func() { panic("panicked") }, []Option{WithMaxRestarts(1)}},
+	} {
+		var calls int32
+		done := make(chan struct{})
+		GoDone(nil, tt.do, func() {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(done)
+			}
+		}, tt.opts...)
+		<-done
+		time.Sleep(10 * time.Millisecond)
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Errorf("%s: expected done to be called once, got %d", tt.name, n)
+		}
+	}
+	t.Run("Stopped", func(t *testing.T) {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		GoDone(stop, func() {
+			panic("panicked")
+		}, func() {
+			close(done)
+		}, WithBackoff(time.Hour, 0))
+		close(stop)
+		<-done
+	})
+}
+
+func TestGoExitCode(t *testing.T) {
+	logs := captureLogs(t)
+	var i int32
+	var restarts []interface{}
+	h := GoExitCode(nil, func(code int) bool {
+		return code != 0
+	}, func() int {
+		return 3 - int(atomic.AddInt32(&i, 1))
+	}, WithOnRestart(func(attempt int, r interface{}) {
+		restarts = append(restarts, r)
+	}))
+	h.Wait()
+	if h.Reason() != StopReasonClean || h.Restarts() != 2 || atomic.LoadInt32(&i) != 3 {
+		t.Errorf("expected two restarts and a clean exit, got %d restarts (%v)", h.Restarts(), h.Reason())
+	}
+	if len(restarts) != 2 || restarts[0] != ExitCode(2) || restarts[1] != ExitCode(1) {
+		t.Errorf("expected the restart hook to receive the exit codes, got %v", restarts)
+	}
+	if lines := logs(); len(lines) != 2 || lines[0] != "Worker returned exit code 2; restarting (attempt 2)" {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+
+	h = GoExitCode(nil, func(int) bool { return true }, func() int { return 1 }, WithMaxRestarts(2))
+	h.Wait()
+	if h.Reason() != StopReasonMaxRestarts || h.Restarts() != 2 {
+		t.Errorf("expected to give up after two restarts, got %d (%v)", h.Restarts(), h.Reason())
+	}
+	lines := logs()
+	if len(lines) != 5 || lines[3] != "Worker returned exit code 1; restarting (attempt 3); restart 2 of 2, 0 remaining" ||
+		lines[4] != "Worker returned exit code 1; giving up (attempt 3): max restarts exceeded after 3 attempts" {
+		t.Errorf("expected the restarts to count down, got %q", lines)
+	}
+}
+
+func TestGo_NilStop(t *testing.T) {
+	var i int32
+	h := Go(nil, func() {
+		if atomic.AddInt32(&i, 1) < 3 {
+			panic("panicked")
+		}
+		select {}
+	})
+	for atomic.LoadInt32(&i) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := h.WaitContext(timeout(t, 10*time.Millisecond)); err == nil {
+		t.Error("expected a nil stop channel to never stop")
+	}
+	h.Stop()
+	h.Wait()
+	if h.Reason() != StopReasonStopped {
+		t.Errorf("expected Stop to stop supervision, got %v", h.Reason())
+	}
+}
+
+func TestGoForever(t *testing.T) {
+	captureLogs(t)
+	h := GoForever(func() {
+		panic("panicked")
+	}, WithMaxRestarts(2))
+	h.Wait()
+	if h.Reason() != StopReasonMaxRestarts {
+		t.Errorf("expected to run until giving up, got %v", h.Reason())
+	}
+
+	h = GoForever(func() {
+		select {}
+	})
+	<-h.Started()
+	h.Stop()
+	h.Wait()
+	if h.Reason() != StopReasonStopped {
+		t.Errorf("expected Stop to stop supervision, got %v", h.Reason())
+	}
+}
+
+func TestGoTomb_Nil(t *testing.T) {
+	for name, fn := range map[string]func(){
+		"GoTomb":         func() { GoTomb(nil, func() error { return nil }) },
+		"BlockingGoTomb": func() { BlockingGoTomb(nil, func() error { return nil }) },
+		"GoTombValue":    func() { GoTombValue(nil, func() (int, error) { return 0, nil }) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != "reroutine: nil Tomb" {
+					t.Errorf("%s: expected to panic on a nil tomb, got %v", name, r)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestGoDrain(t *testing.T) {
+	t.Run("Drain", func(t *testing.T) {
+		drain := make(chan struct{})
+		queue := make(chan int)
+		var processed int32
+		h := GoDrain(drain, nil, func(drain, stop <-chan struct{}) {
+			for {
+				select {
+				case <-drain:
+					return
+				case <-stop:
+					t.Error("expected to drain rather than stop")
+					return
+				case <-queue:
+					atomic.AddInt32(&processed, 1)
+				}
+			}
+		})
+		queue <- 1
+		queue <- 2
+		close(drain)
+		h.Wait()
+		if h.Reason() != StopReasonClean || atomic.LoadInt32(&processed) != 2 {
+			t.Errorf("expected a clean exit after processing, got %v", h.Reason())
+		}
+	})
+	t.Run("Stop", func(t *testing.T) {
+		stopped := make(chan struct{})
+		h := GoDrain(nil, nil, func(drain, stop <-chan struct{}) {
+			<-stop
+			close(stopped)
+		})
+		<-h.Started()
+		h.Stop()
+		<-stopped
+		h.Wait()
+	})
+}
+
+func TestGoPoll(t *testing.T) {
+	captureLogs(t)
+	t.Run("Idle", func(t *testing.T) {
+		// Work, work, idle, panic, work, idle, idle, idle.
+		work := []bool{true, true, false, false, true, false, false, false}
+		var i int32
+		h := GoPoll(nil, 3, func() bool {
+			n := atomic.AddInt32(&i, 1) - 1
+			if n == 3 {
+				panic("panicked")
+			}
+			return work[n]
+		})
+		h.Wait()
+		if n := atomic.LoadInt32(&i); n != int32(len(work)) || h.Restarts() != 1 || h.Reason() != StopReasonClean {
+			t.Errorf("expected to stop after 3 idle iterations, got %d iterations and %d restarts (%v)", n, h.Restarts(), h.Reason())
+		}
+	})
+	t.Run("Stop", func(t *testing.T) {
+		stop := make(chan struct{})
+		var i int32
+		h := GoPoll(stop, 0, func() bool {
+			if atomic.AddInt32(&i, 1) == 10 {
+				close(stop)
+			}
+			return false
+		})
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Errorf("expected to be stopped, got %v", h.Reason())
+		}
+	})
+}
+
+func TestGoContext_RestartTrigger(t *testing.T) {
+	logs := captureLogs(t)
+	trigger := make(chan struct{})
+	attempts := make(chan int)
+	h := GoContext(context.Background(), func(ctx context.Context) {
+		attempts <- AttemptFromContext(ctx)
+		<-ctx.Done()
+	}, WithRestartTrigger(trigger))
+	for want := 1; want <= 3; want++ {
+		if attempt := <-attempts; attempt != want {
+			t.Fatalf("expected attempt %d, got %d", want, attempt)
+		}
+		if want < 3 {
+			trigger <- struct{}{}
+		}
+	}
+	h.Stop()
+	h.Wait()
+	if h.TriggeredRestarts() != 2 || h.Restarts() != 0 {
+		t.Errorf("expected 2 triggered restarts and no others, got %d and %d", h.TriggeredRestarts(), h.Restarts())
+	}
+	if lines := logs(); len(lines) != 2 || lines[0] != "Restart triggered; restarting (attempt 2)" {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+
+	t.Run("Uncancellable", func(t *testing.T) {
+		trigger := make(chan struct{})
+		release := make(chan struct{})
+		var i int32
+		h := Go(nil, func() {
+			if atomic.AddInt32(&i, 1) == 1 {
+				<-release
+			}
+		}, WithRestartTrigger(trigger))
+		<-h.Started()
+		// The second send only completes once the first has been handled.
+		trigger <- struct{}{}
+		trigger <- struct{}{}
+		close(release)
+		h.Wait()
+		if atomic.LoadInt32(&i) != 2 || h.TriggeredRestarts() != 1 || h.Reason() != StopReasonClean {
+			t.Errorf("expected the worker to be restarted once it returned, got %d invocations (%v)", i, h.Reason())
+		}
+	})
+}
+
+func TestGoContext_TriggerDebounce(t *testing.T) {
+	captureLogs(t)
+	clock := newFakeClock()
+	trigger := make(chan struct{})
+	attempts := make(chan int, 4)
+	h := GoContext(context.Background(), func(ctx context.Context) {
+		attempts <- AttemptFromContext(ctx)
+		<-ctx.Done()
+	}, WithClock(clock), WithRestartTrigger(trigger), WithTriggerDebounce(10*time.Second))
+	if attempt := <-attempts; attempt != 1 {
+		t.Fatalf("expected attempt 1, got %d", attempt)
+	}
+	// A burst of triggers, each within the window of the previous one.
+	for i := 0; i < 3; i++ {
+		trigger <- struct{}{}
+		<-clock.added
+		clock.Advance(5 * time.Second)
+	}
+	close(trigger)
+	select {
+	case attempt := <-attempts:
+		t.Fatalf("expected the burst to be coalesced, got attempt %d", attempt)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// The window of the last trigger ends, even though trigger was closed.
+	clock.Advance(5 * time.Second)
+	if attempt := <-attempts; attempt != 2 {
+		t.Fatalf("expected attempt 2, got %d", attempt)
+	}
+	h.Stop()
+	h.Wait()
+	if h.TriggeredRestarts() != 1 {
+		t.Errorf("expected a single triggered restart, got %d", h.TriggeredRestarts())
+	}
+}
+
+func TestGo_Fatal(t *testing.T) {
+	captureLogs(t)
+	errBroken := errors.New("broken")
+	for name, r := range map[string]interface{}{
+		"Value":   Fatal{Err: errBroken},
+		"Pointer": &Fatal{Err: errBroken},
+		"Wrapped": fmt.Errorf("loading: %w", Fatal{Err: errBroken}),
+	} {
+		var i int32
+		h := Go(nil, func() {
+			atomic.AddInt32(&i, 1)
+			panic(r)
+		})
+		h.Wait()
+		if h.Reason() != StopReasonFatal || atomic.LoadInt32(&i) != 1 || h.Err() != errBroken {
+			t.Errorf("%s: expected to give up without restarting, got %d invocations (%v, %v)", name, i, h.Reason(), h.Err())
+		}
+	}
+
+	var ts mockTomb
+	ts.Go(func() error {
+		<-ts.Dying()
+		return nil
+	})
+	GoTomb(&ts, func() error {
+		panic(Fatal{Err: errBroken})
+	})
+	if err := ts.Wait(); !errors.Is(err, errBroken) {
+		t.Errorf("expected the tomb to be killed with the wrapped error, got %v", err)
+	}
+}
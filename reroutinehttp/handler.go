@@ -0,0 +1,58 @@
+// Package reroutinehttp serves the supervisors tracked by the reroutine
+// registry over HTTP. It's kept separate so that importing reroutine doesn't
+// pull in net/http.
+package reroutinehttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+// Supervisor is the JSON representation of a reroutine.SupervisorInfo.
+type Supervisor struct {
+	Name      string  `json:"name,omitempty"`
+	State     string  `json:"state"`
+	Restarts  int     `json:"restarts"`
+	LastPanic string  `json:"last_panic,omitempty"`
+	Uptime    float64 `json:"uptime_seconds"`
+}
+
+// Handler returns a read-only http.Handler that renders reroutine.Snapshot as
+// a JSON array, typically mounted at /debug/reroutines. It enables the
+// registry, so only supervisors started after Handler is called are listed.
+func Handler() http.Handler {
+	reroutine.EnableRegistry()
+	return http.HandlerFunc(serve)
+}
+
+func serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	snapshot := reroutine.Snapshot()
+	supervisors := make([]Supervisor, 0, len(snapshot))
+	for _, info := range snapshot {
+		s := Supervisor{
+			Name:     info.Name,
+			State:    info.State,
+			Restarts: info.Restarts,
+			Uptime:   now.Sub(info.Started).Seconds(),
+		}
+		if info.LastPanic != nil {
+			s.LastPanic = fmt.Sprint(info.LastPanic)
+		}
+		supervisors = append(supervisors, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(w).Encode(supervisors)
+}
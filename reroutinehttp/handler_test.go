@@ -0,0 +1,51 @@
+package reroutinehttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/clarkmcc/go-reroutine"
+	"github.com/clarkmcc/go-reroutine/reroutinetest"
+)
+
+func TestHandler(t *testing.T) {
+	defer func(printError func(string)) { reroutine.PrintError = printError }(reroutine.PrintError)
+	reroutine.PrintError = func(string) {}
+
+	handler := Handler()
+	stop := make(chan struct{})
+	defer close(stop)
+	var started bool
+	h := reroutine.Go(stop, func() {
+		if !started {
+			started = true
+			panic("panicked")
+		}
+		<-stop
+	}, reroutine.WithName("worker"))
+	if err := reroutinetest.WaitForRestarts(h, 1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/reroutines", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var supervisors []Supervisor
+	if err := json.NewDecoder(rec.Body).Decode(&supervisors); err != nil {
+		t.Fatal(err)
+	}
+	if len(supervisors) != 1 || supervisors[0].Name != "worker" || supervisors[0].Restarts != 1 || supervisors[0].LastPanic != "panicked" {
+		t.Errorf("unexpected supervisors %+v", supervisors)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/reroutines", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST to be rejected, got %d", rec.Code)
+	}
+}
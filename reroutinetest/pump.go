@@ -0,0 +1,54 @@
+package reroutinetest
+
+import "github.com/clarkmcc/go-reroutine"
+
+// Pump supervises a worker whose invocations only run when Step is called, so
+// that tests can drive restarts one at a time without depending on timing.
+// Every invocation runs on the go-routine that calls Step.
+type Pump struct {
+	h       *reroutine.Handle
+	queue   chan func()
+	stopped chan struct{}
+}
+
+// NewPump starts supervising do with opts, as reroutine.Go does, but doesn't
+// run any invocation until Step is called. The supervisor still applies its
+// backoff and rate limits before queueing each restart, so any delays should
+// either be avoided or driven by a fake clock from another go-routine, as
+// Step blocks until the next invocation is queued. reroutine.WithInline and
+// reroutine.WithExecutor must not be passed in opts.
+func NewPump(do func(), opts ...reroutine.Option) *Pump {
+	p := &Pump{
+		// A supervisor only queues one invocation at a time, so queueing
+		// never blocks, even once the handle is stopped.
+		queue:   make(chan func(), 1),
+		stopped: make(chan struct{}),
+	}
+	executor := reroutine.ExecutorFunc(func(f func()) {
+		p.queue <- f
+	})
+	p.h = reroutine.Go(nil, do, append(opts, reroutine.WithExecutor(executor))...)
+	go func() {
+		p.h.Wait()
+		close(p.stopped)
+	}()
+	return p
+}
+
+// Handle returns the handle of the supervised go-routine.
+func (p *Pump) Handle() *reroutine.Handle {
+	return p.h
+}
+
+// Step runs the next invocation of the worker and returns once it has returned
+// or panicked and the panic was handled. It returns false without running
+// anything once supervision has ended.
+func (p *Pump) Step() bool {
+	select {
+	case f := <-p.queue:
+		f()
+		return true
+	case <-p.stopped:
+		return false
+	}
+}
@@ -0,0 +1,30 @@
+package reroutinetest
+
+import (
+	"testing"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+func TestPump(t *testing.T) {
+	invocations := 0
+	p := NewPump(func() {
+		if invocations++; invocations < 3 {
+			panic("panicked")
+		}
+	})
+	for i := 1; i <= 3; i++ {
+		if !p.Step() {
+			t.Fatalf("expected step %d to run an invocation", i)
+		}
+		if invocations != i {
+			t.Fatalf("expected exactly %d invocations after step %d, got %d", i, i, invocations)
+		}
+	}
+	if p.Step() {
+		t.Error("expected no more steps after a clean exit")
+	}
+	if reason := p.Handle().Reason(); reason != reroutine.StopReasonClean {
+		t.Errorf("expected a clean exit, got %v", reason)
+	}
+}
@@ -0,0 +1,36 @@
+package reroutinetest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+// WithTestingT reports every panic recovered by the supervisor as a failure of
+// the test t, with the panic's stack trace, so that panics in supervised
+// workers, including failed assertions, aren't hidden by restarts. The
+// supervisor still restarts the worker as configured. Panics recovered after
+// the test has finished are ignored, as t can no longer be used. It's built on
+// reroutine.WithOnPanic, so it replaces, and is replaced by, any other
+// WithOnPanic option.
+func WithTestingT(t testing.TB) reroutine.Option {
+	var (
+		m    sync.Mutex
+		done bool
+	)
+	t.Cleanup(func() {
+		m.Lock()
+		defer m.Unlock()
+		done = true
+	})
+	return reroutine.WithOnPanic(func(info reroutine.PanicInfo) {
+		m.Lock()
+		defer m.Unlock()
+		if done {
+			return
+		}
+		t.Helper()
+		t.Errorf("reroutinetest: supervised worker panicked (attempt %d): %v\n%s", info.Attempt, info.Value, info.Stack)
+	})
+}
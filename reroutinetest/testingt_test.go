@@ -0,0 +1,32 @@
+package reroutinetest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+// recordingT records the failures reported through it.
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestWithTestingT(t *testing.T) {
+	rt := &recordingT{TB: t}
+	reroutine.Go(nil, func() {
+		panic("panicked")
+	}, WithTestingT(rt), reroutine.WithMaxRestarts(1), reroutine.WithBackoff(0, 0)).Wait()
+	if len(rt.errors) != 2 {
+		t.Fatalf("expected a failure for each panic, got %q", rt.errors)
+	}
+	if msg := rt.errors[0]; !strings.Contains(msg, "attempt 1): panicked") || !strings.Contains(msg, "goroutine ") {
+		t.Errorf("expected the failure to describe the panic and its stack, got %q", msg)
+	}
+}
@@ -0,0 +1,48 @@
+// Package reroutinetest provides helpers for testing code that uses reroutine.
+package reroutinetest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+// pollInterval is how often WaitForRestarts checks the restart count.
+const pollInterval = time.Millisecond
+
+// WaitForRestarts waits until the go-routine supervised by h has been
+// restarted at least n times, returning an error if that doesn't happen within
+// timeout or if supervision ends first.
+func WaitForRestarts(h *reroutine.Handle, n int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		restarts := h.Restarts()
+		if restarts >= n {
+			return nil
+		}
+		if reason := h.Reason(); reason != reroutine.StopReasonNone {
+			return fmt.Errorf("reroutinetest: supervision ended (%v) after %d restarts, expected %d", reason, restarts, n)
+		}
+		select {
+		case <-deadline.C:
+			return fmt.Errorf("reroutinetest: %d restarts after %v, expected %d", restarts, timeout, n)
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForStop waits until supervision by h has ended, returning an error if it
+// hasn't within timeout.
+func WaitForStop(h *reroutine.Handle, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := h.WaitContext(ctx); err != nil {
+		return fmt.Errorf("reroutinetest: still supervising after %v", timeout)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package reroutinetest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/clarkmcc/go-reroutine"
+)
+
+func TestMain(m *testing.M) {
+	// Panicking invocations can still be logging after a test has returned,
+	// so silence them for the whole run.
+	reroutine.PrintError = func(string) {}
+	os.Exit(m.Run())
+}
+
+func TestWaitForRestarts(t *testing.T) {
+	h := reroutine.Go(nil, func() {
+		panic("panicked")
+	}, reroutine.WithBackoff(time.Millisecond, 0))
+	defer h.Stop()
+	if err := WaitForRestarts(h, 3, time.Second); err != nil {
+		t.Error(err)
+	}
+	if err := WaitForRestarts(h, 1<<30, 10*time.Millisecond); err == nil {
+		t.Error("expected to time out")
+	}
+
+	h = reroutine.Go(nil, func() {
+		panic("panicked")
+	}, reroutine.WithMaxRestarts(1))
+	if err := WaitForRestarts(h, 2, time.Second); err == nil {
+		t.Error("expected supervision to end first")
+	}
+}
+
+func TestWaitForStop(t *testing.T) {
+	h := reroutine.Go(nil, func() {})
+	if err := WaitForStop(h, time.Second); err != nil {
+		t.Error(err)
+	}
+	h = reroutine.Go(nil, func() {
+		select {}
+	})
+	if err := WaitForStop(h, 10*time.Millisecond); err == nil {
+		t.Error("expected to time out")
+	}
+	h.Stop()
+	if err := WaitForStop(h, time.Second); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package reroutine
+
+import (
+	"fmt"
+	"time"
+)
+
+// Result is returned by a worker supervised with GoResult to direct its own
+// supervision.
+type Result struct {
+	// Restart asks for the worker to be restarted, subject to the same options
+	// as a panic, such as WithMaxRestarts. Otherwise, supervision ends as it
+	// does when a worker returns without panicking.
+	Restart bool
+	// Delay, if positive, is waited before restarting instead of the backoff
+	// configured with WithBackoff, as if the worker had panicked with Backoff.
+	Delay time.Duration
+	// Err is the error the worker ended with, if any. It's logged when
+	// restarting and is available from Handle.Err.
+	Err error
+}
+
+func (r Result) String() string {
+	msg := "stop"
+	if r.Restart {
+		msg = "restart"
+		if r.Delay > 0 {
+			msg = fmt.Sprintf("restart after %v", r.Delay)
+		}
+	}
+	if r.Err != nil {
+		msg += ": " + r.Err.Error()
+	}
+	return msg
+}
+
+// StopResult returns a Result that ends supervision.
+func StopResult() Result {
+	return Result{}
+}
+
+// RestartResult returns a Result that restarts the worker after the
+// configured backoff.
+func RestartResult() Result {
+	return Result{Restart: true}
+}
+
+// RestartAfter returns a Result that restarts the worker after d.
+func RestartAfter(d time.Duration) Result {
+	return Result{Restart: true, Delay: d}
+}
+
+// GoResult is like Go for a worker that decides for itself whether it is
+// restarted by returning a Result. Panics are restarted as usual. The
+// restart hooks and predicates, such as WithRestartIf, receive the Result in
+// place of a recovered value.
+func GoResult(stopChan <-chan struct{}, do func() Result, opts ...Option) *Handle {
+	s := newSupervisor(opts)
+	var result Result
+	s.do = func(int) {
+		result = do()
+	}
+	s.returned = func() (interface{}, bool) {
+		s.setErr(result.Err)
+		return result, result.Restart
+	}
+	return start(stopChan, s, s.Run)
+}
@@ -0,0 +1,71 @@
+package reroutine
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGoResult(t *testing.T) {
+	logs := captureLogs(t)
+	errFailed := errors.New("failed")
+	clock := newFakeClock()
+	i := 0
+	h := GoResult(nil, func() Result {
+		switch i++; i {
+		case 1:
+			return Result{Restart: true, Err: errFailed}
+		case 2:
+			return RestartAfter(time.Minute)
+		default:
+			return Result{Err: errFailed}
+		}
+	}, WithClock(clock), WithBackoff(time.Hour, 0))
+	<-clock.added
+	clock.Advance(time.Hour)
+	<-clock.added
+	clock.Advance(time.Minute)
+	h.Wait()
+	if h.Reason() != StopReasonClean || h.Restarts() != 2 || !errors.Is(h.Err(), errFailed) {
+		t.Errorf("expected two restarts and then to stop with the error, got %d (%v, %v)", h.Restarts(), h.Reason(), h.Err())
+	}
+	lines := logs()
+	if len(lines) != 2 || lines[0] != "Worker returned restart: failed; restarting (attempt 2)" || lines[1] != "Worker returned restart after 1m0s; restarting (attempt 3)" {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+}
+
+func TestGoResult_StopIsError(t *testing.T) {
+	captureLogs(t)
+	for _, isError := range []bool{false, true} {
+		clock := newFakeClock()
+		h := GoResult(nil, RestartResult, WithClock(clock), WithBackoff(time.Hour, 0), WithStopIsError(isError))
+		<-clock.added
+		h.Stop()
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Fatalf("expected to be stopped while backing off, got %v", h.Reason())
+		}
+		if err := h.Err(); isError && !errors.Is(err, ErrStopped) || !isError && err != nil {
+			t.Errorf("expected stopping to be an error only with WithStopIsError(true), got %v with %v", err, isError)
+		}
+	}
+
+	h := GoResult(nil, StopResult, WithStopIsError(true))
+	h.Wait()
+	if h.Reason() != StopReasonClean || h.Err() != nil {
+		t.Errorf("expected a clean exit not to be an error, got %v (%v)", h.Err(), h.Reason())
+	}
+}
+
+func TestResult_Helpers(t *testing.T) {
+	if r := StopResult(); r.Restart {
+		t.Error("expected StopResult not to restart")
+	}
+	if r := RestartResult(); !r.Restart || r.Delay != 0 {
+		t.Error("expected RestartResult to restart after the backoff")
+	}
+	if r := RestartAfter(time.Second); !r.Restart || r.Delay != time.Second {
+		t.Error("expected RestartAfter to restart after the delay")
+	}
+}
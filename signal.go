@@ -0,0 +1,52 @@
+package reroutine
+
+import "sync"
+
+// closedChan is a channel that is always closed.
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// signal is a one-shot event, like a channel that is closed once, except that
+// the channel is only allocated if something waits for the event before it
+// happens, which most supervisors never need. The zero value is ready to use.
+type signal struct {
+	m    sync.Mutex
+	c    chan struct{}
+	done bool
+}
+
+// wait returns a channel that is closed once the event has happened.
+func (sg *signal) wait() <-chan struct{} {
+	sg.m.Lock()
+	defer sg.m.Unlock()
+	if sg.c == nil {
+		if sg.done {
+			return closedChan
+		}
+		sg.c = make(chan struct{})
+	}
+	return sg.c
+}
+
+// fired reports whether the event has happened.
+func (sg *signal) fired() bool {
+	sg.m.Lock()
+	defer sg.m.Unlock()
+	return sg.done
+}
+
+// fire records that the event has happened. Only the first call has an
+// effect.
+func (sg *signal) fire() {
+	sg.m.Lock()
+	defer sg.m.Unlock()
+	if !sg.done {
+		sg.done = true
+		if sg.c != nil {
+			close(sg.c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package reroutine
+
+import "sync"
+
+// The stack traces retained by event buffers, which are capped once
+// SetMaxRetainedStackBytes has been called.
+var (
+	retainedM     sync.Mutex
+	maxRetained   int
+	retainedBytes int
+	retained      []*retainedStack
+	retainedSigs  map[string]int
+)
+
+// retainedStack is a stack trace retained after its panic was handled, which
+// may be dropped to honour SetMaxRetainedStackBytes.
+type retainedStack struct {
+	b   []byte
+	sig string
+}
+
+// SetMaxRetainedStackBytes caps the total size of the stack traces retained by
+// the event buffers of all supervisors, see Event.Stack, so that a crash loop
+// can't exhaust memory with them. Once the cap is exceeded, the oldest stacks
+// are dropped first, except that stacks whose crash signature is shared with a
+// more recent stack are dropped before any others, so the most recent stack of
+// every distinct signature is kept the longest. Only stacks retained after
+// the cap is set count towards it. An n of zero or less removes the cap.
+func SetMaxRetainedStackBytes(n int) {
+	retainedM.Lock()
+	defer retainedM.Unlock()
+	maxRetained = n
+	if n <= 0 {
+		retained, retainedBytes, retainedSigs = nil, 0, nil
+		return
+	}
+	trimRetainedLocked()
+}
+
+// retainStack retains stack, whose crash signature is sig, subject to the cap.
+func retainStack(stack []byte, sig string) *retainedStack {
+	rs := &retainedStack{b: stack, sig: sig}
+	retainedM.Lock()
+	defer retainedM.Unlock()
+	if maxRetained <= 0 {
+		return rs
+	}
+	if retainedSigs == nil {
+		retainedSigs = map[string]int{}
+	}
+	retained = append(retained, rs)
+	retainedBytes += len(stack)
+	retainedSigs[sig]++
+	trimRetainedLocked()
+	return rs
+}
+
+// trimRetainedLocked drops stacks until the retained ones fit within the cap.
+func trimRetainedLocked() {
+	for retainedBytes > maxRetained && len(retained) > 0 {
+		victim := 0
+		for i, rs := range retained {
+			if retainedSigs[rs.sig] > 1 {
+				victim = i
+				break
+			}
+		}
+		rs := retained[victim]
+		retained = append(retained[:victim], retained[victim+1:]...)
+		retainedBytes -= len(rs.b)
+		if retainedSigs[rs.sig]--; retainedSigs[rs.sig] == 0 {
+			delete(retainedSigs, rs.sig)
+		}
+		rs.b = nil
+	}
+}
+
+// get returns the stack, or nil if it was dropped.
+func (rs *retainedStack) get() []byte {
+	retainedM.Lock()
+	defer retainedM.Unlock()
+	return rs.b
+}
@@ -0,0 +1,25 @@
+package reroutine
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSetMaxRetainedStackBytes(t *testing.T) {
+	SetMaxRetainedStackBytes(25)
+	defer SetMaxRetainedStackBytes(0)
+	event := func(sig string) Event {
+		return panicEvent(1, StopReasonNone, PanicInfo{Stack: bytes.Repeat([]byte(sig), 10), Fingerprint: sig})
+	}
+	oldA, b, newA := event("a"), event("b"), event("a")
+	if oldA.Stack() != nil || b.Stack() == nil || newA.Stack() == nil {
+		t.Errorf("expected the older stack of a repeated signature to be dropped first")
+	}
+	SetMaxRetainedStackBytes(15)
+	if b.Stack() != nil || newA.Stack() == nil {
+		t.Errorf("expected the oldest stack to be dropped once signatures are distinct")
+	}
+	if newA.Panic.Stack != nil {
+		t.Error("expected the stack to only be available through Event.Stack")
+	}
+}
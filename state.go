@@ -0,0 +1,67 @@
+package reroutine
+
+import "sync"
+
+// State holds resources that a worker started with GoState keeps across
+// restarts, such as caches that are expensive to rebuild. The same State is
+// passed to every invocation of the worker. Since a panic can leave a resource
+// half updated, the worker is responsible for checking that what it finds in
+// the State is still consistent before reusing it. A State is safe for
+// concurrent use, including by an invocation left running after stop.
+type State struct {
+	m      sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// Load returns the value stored for key, if any.
+func (st *State) Load(key interface{}) (value interface{}, ok bool) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	value, ok = st.values[key]
+	return value, ok
+}
+
+// Store stores value for key, replacing any previous value.
+func (st *State) Store(key, value interface{}) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	if st.values == nil {
+		st.values = map[interface{}]interface{}{}
+	}
+	st.values[key] = value
+}
+
+// LoadOrInit returns the value stored for key, storing the value returned by
+// init first if there is none, for example to build a resource during the first
+// invocation and reuse it afterwards. init runs with the State locked, so it
+// must not use the State itself. If init panics, nothing is stored.
+func (st *State) LoadOrInit(key interface{}, init func() interface{}) interface{} {
+	st.m.Lock()
+	defer st.m.Unlock()
+	if value, ok := st.values[key]; ok {
+		return value
+	}
+	value := init()
+	if st.values == nil {
+		st.values = map[interface{}]interface{}{}
+	}
+	st.values[key] = value
+	return value
+}
+
+// Delete removes the value stored for key, for example to rebuild a resource
+// that a panic may have left inconsistent.
+func (st *State) Delete(key interface{}) {
+	st.m.Lock()
+	defer st.m.Unlock()
+	delete(st.values, key)
+}
+
+// GoState is like Go for a worker that keeps resources across restarts in a
+// State, which is the same for every invocation.
+func GoState(stopChan <-chan struct{}, do func(state *State), opts ...Option) *Handle {
+	state := &State{}
+	return Go(stopChan, func() {
+		do(state)
+	}, opts...)
+}
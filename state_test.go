@@ -0,0 +1,28 @@
+package reroutine
+
+import "testing"
+
+func TestGoState(t *testing.T) {
+	captureLogs(t)
+	var inits, invocations int
+	var states []*State
+	h := GoState(nil, func(state *State) {
+		invocations++
+		states = append(states, state)
+		cache := state.LoadOrInit("cache", func() interface{} {
+			inits++
+			return map[string]int{}
+		}).(map[string]int)
+		if cache["runs"]++; cache["runs"] < 3 {
+			panic("panicked")
+		}
+	})
+	h.Wait()
+	if invocations != 3 || inits != 1 || states[0] != states[2] {
+		t.Errorf("expected the state to survive restarts, got %d invocations and %d inits", invocations, inits)
+	}
+	states[0].Delete("cache")
+	if _, ok := states[0].Load("cache"); ok {
+		t.Error("expected the value to be deleted")
+	}
+}
@@ -0,0 +1,41 @@
+package reroutine
+
+import "reflect"
+
+// AnyClosed returns a channel that is closed as soon as any of chans is closed,
+// so that several stop conditions can be combined into the single stop channel
+// the rest of the package expects:
+//
+//	Go(AnyClosed(globalStop, localStop), worker)
+//
+// AnyClosed uses a go-routine to watch chans, which exits once the returned
+// channel has been closed. If none of chans is ever closed, it is never
+// released. Nil channels are ignored and AnyClosed returns nil, which is never
+// closed, if there are no other channels. Values sent on chans are received
+// and discarded rather than closing the returned channel.
+func AnyClosed(chans ...<-chan struct{}) <-chan struct{} {
+	cases := make([]reflect.SelectCase, 0, len(chans))
+	for _, c := range chans {
+		if c != nil {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+		}
+	}
+	switch len(cases) {
+	case 0:
+		return nil
+	case 1:
+		return cases[0].Chan.Interface().(<-chan struct{})
+	}
+	closed := make(chan struct{})
+	spawn(func() {
+		defer close(closed)
+		for {
+			// Values sent on the channels are discarded: only closing one
+			// counts.
+			if _, _, ok := reflect.Select(cases); !ok {
+				return
+			}
+		}
+	})
+	return closed
+}
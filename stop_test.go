@@ -0,0 +1,69 @@
+package reroutine
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestAnyClosed(t *testing.T) {
+	t.Run("Closes when any closes", func(t *testing.T) {
+		before := runtime.NumGoroutine()
+		a, b, c := make(chan struct{}), make(chan struct{}), make(chan struct{})
+		stop := AnyClosed(a, nil, b, c)
+		select {
+		case <-stop:
+			t.Fatal("expected the channel to be open")
+		default:
+		}
+		close(b)
+		select {
+		case <-stop:
+		case <-time.After(time.Second):
+			t.Fatal("expected the channel to be closed")
+		}
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if runtime.NumGoroutine() > before {
+			t.Error("expected the watching go-routine to exit")
+		}
+	})
+	t.Run("Ignores sent values", func(t *testing.T) {
+		a, b := make(chan struct{}), make(chan struct{})
+		stop := AnyClosed(a, b)
+		a <- struct{}{}
+		select {
+		case <-stop:
+			t.Fatal("expected a sent value not to close the channel")
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(a)
+		select {
+		case <-stop:
+		case <-time.After(time.Second):
+			t.Fatal("expected the channel to be closed")
+		}
+	})
+	t.Run("Single", func(t *testing.T) {
+		a := make(chan struct{})
+		if AnyClosed(nil, a) != (<-chan struct{})(a) {
+			t.Error("expected a single channel to be returned as is")
+		}
+		if AnyClosed() != nil || AnyClosed(nil) != nil {
+			t.Error("expected nil without any channels")
+		}
+	})
+	t.Run("Stops supervisor", func(t *testing.T) {
+		global, local := make(chan struct{}), make(chan struct{})
+		h := Go(AnyClosed(global, local), func() {
+			select {}
+		})
+		close(local)
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Errorf("expected stopped, got %v", h.Reason())
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package reroutine
+
+// StopReason describes why supervision of a go-routine ended.
+type StopReason int
+
+const (
+	// StopReasonNone means supervision has not ended yet.
+	StopReasonNone StopReason = iota
+	// StopReasonClean means the worker returned without panicking. It takes
+	// precedence over a stop that happens as the worker returns, provided the
+	// supervisor has seen the return by then. Either way, a worker that
+	// returned is never started again.
+	StopReasonClean
+	// StopReasonStopped means supervision was stopped from the outside, by
+	// closing the stop channel, cancelling the context, killing the tomb or
+	// calling Handle.Stop.
+	StopReasonStopped
+	// StopReasonCrash means the panic was re-raised because ReallyCrash is set.
+	StopReasonCrash
+	// StopReasonMaxRestarts means the worker panicked after exhausting the
+	// restarts allowed by WithMaxRestarts.
+	StopReasonMaxRestarts
+	// StopReasonPredicate means the predicate configured with WithRestartIf
+	// declined to restart the worker.
+	StopReasonPredicate
+	// StopReasonBudgetExceeded means the worker panicked after the retry
+	// budget configured with WithRetryBudget had elapsed.
+	StopReasonBudgetExceeded
+	// StopReasonCallbackAborted means the hook configured with
+	// WithRestartHook declined to restart the worker.
+	StopReasonCallbackAborted
+	// StopReasonPolicy means the policy configured with WithRestartPolicy
+	// declined to restart the worker.
+	StopReasonPolicy
+	// StopReasonFatal means the worker panicked with a Fatal value.
+	StopReasonFatal
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopReasonNone:
+		return "none"
+	case StopReasonClean:
+		return "clean exit"
+	case StopReasonStopped:
+		return "stopped"
+	case StopReasonCrash:
+		return "crash"
+	case StopReasonMaxRestarts:
+		return "max restarts exceeded"
+	case StopReasonPredicate:
+		return "restart declined"
+	case StopReasonBudgetExceeded:
+		return "retry budget exceeded"
+	case StopReasonCallbackAborted:
+		return "restart aborted by callback"
+	case StopReasonPolicy:
+		return "restart policy declined"
+	case StopReasonFatal:
+		return "fatal panic"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,1280 @@
+package reroutine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// Supervisor restarts a single worker function when it panics. It's what the
+// package-level functions use under the hood, exposed so that it can be
+// embedded in and composed into other types. A Supervisor must not be copied,
+// and Run must only be called once.
+type Supervisor struct {
+	do    func(attempt int)
+	opts  *options
+	begin time.Time // when the first invocation was launched
+
+	// returned, if set, is called after each invocation returns and reports
+	// whether to restart it anyway, along with the value describing why.
+	returned func() (r interface{}, restart bool)
+
+	events   *events // nil unless WithEvents is set
+	notified signal  // once the give up callback, if any, has returned
+	started  signal  // when the first invocation begins
+	healthy  signal  // once an invocation returns cleanly or is stable
+
+	m            sync.Mutex
+	fingerprints map[string]int
+	reason       StopReason
+	finalPanic   interface{}
+	giveUpErr    error         // the error the supervisor gave up with
+	giveUpAt     int           // the attempt the supervisor gave up on
+	stable       chan struct{} // closed to disarm the pending stable timer
+	finalized    bool
+	restarts     int
+	starts       int
+	lastPanic    interface{}
+	replaced     func() // set by SetWorker
+	err          error  // the error of the last Result, for GoResult
+	// The times of the most recent panics, for PanicRate.
+	panicTimes [panicHistory]time.Time
+	panicCount int
+	// The current burst of panics, for WithRepeatLogging.
+	burst         int
+	lastPanicTime time.Time
+	backingOff    bool
+	nextRestart   time.Time     // when the backoff ends, while backing off
+	backoffTime   time.Duration // the total time spent backing off
+	goroutine     int64         // the id of the go-routine of the last invocation
+	// The state of WithRestartTrigger for the running invocation.
+	triggered         bool
+	cancelInvocation  func()
+	triggeredRestarts int
+	verbose           bool // set by SetVerbose
+	semaphoreHeld     bool // whether the restart semaphore is held
+	pendingCallbacks  int  // asynchronous callbacks still running, for Flush
+	injected          *injection
+	// The panic handlers carried by the context of GoContext.
+	ctxHandlers []func(interface{})
+}
+
+// NewSupervisor creates a Supervisor for do configured with opts. Call Run to
+// start supervising.
+func NewSupervisor(do func(), opts ...Option) *Supervisor {
+	s := newSupervisor(opts)
+	s.do = func(int) {
+		do()
+	}
+	return s
+}
+
+func newSupervisor(opts []Option) *Supervisor {
+	s := &Supervisor{
+		opts: newOptions(opts),
+	}
+	if s.opts.events {
+		s.events = &events{mode: s.opts.eventDelivery, c: make(chan Event, s.opts.eventBuffer)}
+	}
+	return s
+}
+
+// Events returns the channel on which the supervisor's events are delivered,
+// which is closed once supervision has ended. It returns nil unless WithEvents
+// is set.
+func (s *Supervisor) Events() <-chan Event {
+	if s.events == nil {
+		return nil
+	}
+	return s.events.c
+}
+
+// Run supervises the worker in the same way as BlockingGo: it does not return
+// until the worker returns without panicking, the supervisor gives up, or stop
+// is closed.
+func (s *Supervisor) Run(stop <-chan struct{}) {
+	s.run(stop, s.do)
+}
+
+// SetWorker replaces the worker with do from the next invocation on. An
+// invocation that is already running keeps running the previous worker until
+// it returns or panics, so do only takes over once the worker is restarted.
+// It replaces the worker of any variant, for example the worker of GoContext,
+// which receives a context, or of GoExitCode, whose exit code is then no
+// longer consulted.
+func (s *Supervisor) SetWorker(do func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.replaced = do
+}
+
+// SetVerbose turns verbose panic logging on or off for this supervisor, for
+// example to debug a flaky worker without changing the global logging. While
+// it's on, every panic is logged along with the stack traces of all
+// go-routines, taking precedence over both WithRepeatLogging, so repeated
+// panics are no longer summarised, and WithLogStackTrace. Custom formats set
+// with SetPanicLogFormat receive the full stack traces as well.
+func (s *Supervisor) SetVerbose(verbose bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.verbose = verbose
+}
+
+func (s *Supervisor) isVerbose() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.verbose
+}
+
+// Err returns the error of the Result returned by the last invocation of a
+// worker supervised with GoResult, the error carried by the Fatal panic the
+// supervisor gave up on, or the reason a tomb implementing ErrReporter was
+// killed with when supervision of a tomb variant ended because it was dying,
+// if any. With WithStopIsError, it also returns ErrStopped once supervision
+// was stopped.
+func (s *Supervisor) Err() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+func (s *Supervisor) setErr(err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.err = err
+}
+
+// replacement returns the worker set with SetWorker, if any.
+func (s *Supervisor) replacement() func() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.replaced
+}
+
+// Started returns a channel that is closed once the first invocation of the
+// worker has begun.
+func (s *Supervisor) Started() <-chan struct{} {
+	return s.started.wait()
+}
+
+// Reason returns why supervision ended, or StopReasonNone if it hasn't.
+func (s *Supervisor) Reason() StopReason {
+	return s.stopReason()
+}
+
+// FinalPanic returns the recovered value of the panic that the supervisor gave
+// up on, or nil if it didn't give up on a panic.
+func (s *Supervisor) FinalPanic() interface{} {
+	return s.terminalPanic()
+}
+
+// Fingerprints returns a copy of the number of panics recovered for each
+// distinct crash fingerprint. See WithFingerprint.
+func (s *Supervisor) Fingerprints() map[string]int {
+	return s.fingerprintCounts()
+}
+
+// markHealthy records that an invocation has returned without panicking or has
+// been stable for the stability window.
+func (s *Supervisor) markHealthy() {
+	s.healthy.fire()
+}
+
+// Restarts returns the number of times the worker has been restarted so far.
+func (s *Supervisor) Restarts() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.restarts
+}
+
+// Stats is a snapshot of the counters of a supervisor.
+type Stats struct {
+	// Starts is the number of invocations of the worker, including the first.
+	Starts int
+	// Panics is the number of panics recovered from the worker.
+	Panics int
+	// Restarts is the number of restarts, as returned by Restarts.
+	Restarts int
+	// TriggeredRestarts is the number of restarts by WithRestartTrigger.
+	TriggeredRestarts int
+	// CleanStops is the number of times the worker returned without
+	// panicking, ending supervision.
+	CleanStops int
+	// GiveUps is the number of times the supervisor gave up on the worker.
+	GiveUps int
+	// BackoffTime is the total time spent backing off before restarts,
+	// including a backoff cut short by stopping.
+	BackoffTime time.Duration
+}
+
+// Stats returns a consistent snapshot of the supervisor's counters. Since
+// supervision only ends once, CleanStops and GiveUps are either zero or one
+// for a single supervisor, but summing the Stats of several supervisors gives
+// meaningful totals.
+func (s *Supervisor) Stats() Stats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	stats := Stats{
+		Starts:            s.starts,
+		Panics:            s.panicCount,
+		Restarts:          s.restarts,
+		TriggeredRestarts: s.triggeredRestarts,
+		BackoffTime:       s.backoffTime,
+	}
+	switch s.reason {
+	case StopReasonNone, StopReasonStopped:
+	case StopReasonClean:
+		stats.CleanStops = 1
+	default:
+		stats.GiveUps = 1
+	}
+	return stats
+}
+
+// TriggeredRestarts returns the number of times the worker has been restarted
+// by WithRestartTrigger so far. These aren't included in Restarts.
+func (s *Supervisor) TriggeredRestarts() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.triggeredRestarts
+}
+
+// markStarted records that an invocation has begun.
+func (s *Supervisor) markStarted() (goroutine int64) {
+	goroutine = currentGoroutineID()
+	s.m.Lock()
+	s.starts++
+	s.goroutine = goroutine
+	s.m.Unlock()
+	s.started.fire()
+	return goroutine
+}
+
+// Goroutine returns the id of the go-routine running the current invocation
+// of the worker, or the last one once it has returned, and zero before the
+// first invocation has started. It's meant for correlating logs in
+// diagnostics only: go-routine ids aren't stable across restarts, since every
+// invocation runs on a new go-routine, and the runtime may reuse them.
+func (s *Supervisor) Goroutine() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.goroutine
+}
+
+// panicInfo describes the panic r recovered from the invocation identified by
+// attempt. It must be called from the deferred function that recovered r.
+func (s *Supervisor) panicInfo(attempt int, r interface{}) PanicInfo {
+	frames, panics := captureFrames()
+	info := PanicInfo{
+		Value:   r,
+		Stack:   captureStack(),
+		Frames:  frames,
+		Panics:  panics,
+		Attempt: attempt,
+		Name:    s.opts.name,
+		Time:    s.opts.clock.Now(),
+	}
+	info.Goroutine = goroutineID(info.Stack)
+	if len(s.opts.tags) > 0 {
+		// Copy the tags so that handlers can't affect later panics.
+		info.Tags = make(map[string]string, len(s.opts.tags))
+		for k, v := range s.opts.tags {
+			info.Tags[k] = v
+		}
+	}
+	if s.opts.fingerprintDepth > 0 {
+		info.Fingerprint = fingerprint(info.Frames, s.opts.fingerprintDepth)
+		s.m.Lock()
+		if s.fingerprints == nil {
+			s.fingerprints = map[string]int{}
+		}
+		s.fingerprints[info.Fingerprint]++
+		info.Occurrences = s.fingerprints[info.Fingerprint]
+		s.m.Unlock()
+	}
+	return info
+}
+
+// fingerprintCounts returns a copy of the number of panics recovered for each
+// fingerprint.
+func (s *Supervisor) fingerprintCounts() map[string]int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	counts := make(map[string]int, len(s.fingerprints))
+	for fp, n := range s.fingerprints {
+		counts[fp] = n
+	}
+	return counts
+}
+
+// decide returns how long to wait before restarting the invocation identified
+// by attempt after it panicked with r, or the reason for not restarting it.
+func (s *Supervisor) decide(attempt int, r interface{}) (time.Duration, StopReason) {
+	if s.reallyCrash() {
+		return 0, StopReasonCrash
+	}
+	return s.decideRestart(attempt, r)
+}
+
+// decideRestart is like decide but ignores ReallyCrash, for restarts that
+// weren't caused by a panic.
+func (s *Supervisor) decideRestart(attempt int, r interface{}) (time.Duration, StopReason) {
+	if f, ok := fatal(r); ok {
+		s.setErr(f.Err)
+		return 0, StopReasonFatal
+	}
+	if s.opts.maxRestarts > 0 && attempt > s.opts.maxRestarts {
+		return 0, StopReasonMaxRestarts
+	}
+	if s.opts.restartIf != nil && !s.opts.restartIf(r) {
+		return 0, StopReasonPredicate
+	}
+	delay := s.backoff(attempt)
+	if b, ok := requestedBackoff(r); ok {
+		delay = b.Duration
+	}
+	if s.opts.policy != nil {
+		d, restart := s.opts.policy.Restart(attempt, r)
+		if !restart {
+			return 0, StopReasonPolicy
+		}
+		if d > delay {
+			delay = d
+		}
+	}
+	var remaining time.Duration
+	if s.opts.budget > 0 {
+		remaining = s.opts.budget - s.opts.clock.Now().Sub(s.begin)
+		if remaining <= 0 {
+			return 0, StopReasonBudgetExceeded
+		}
+	}
+	if s.opts.onRestart != nil && !s.opts.onRestart(attempt, r) {
+		return 0, StopReasonCallbackAborted
+	}
+	if s.opts.restartDelay != nil {
+		if d := s.opts.restartDelay(attempt, r); d > 0 {
+			delay = d
+		}
+	}
+	if s.opts.budget > 0 && delay > remaining {
+		// Don't sleep past the end of the budget.
+		delay = remaining
+	}
+	return delay, StopReasonNone
+}
+
+// reallyCrash reports whether panics should be re-raised rather than
+// restarted, as configured with WithReallyCrash or else by ReallyCrash.
+func (s *Supervisor) reallyCrash() bool {
+	if s.opts.reallyCrash != nil {
+		return *s.opts.reallyCrash
+	}
+	return ReallyCrash
+}
+
+// backoff returns the delay before restarting after the given number of
+// restarts, as configured with WithBackoff.
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	return backoff(s.opts.backoffMin, s.opts.backoffMax, restarts)
+}
+
+// sleep waits for d to elapse, returning false if stop is closed first.
+func (s *Supervisor) sleep(d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	t := s.opts.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// setReason records why supervision ended, unless a reason was already
+// recorded.
+func (s *Supervisor) setReason(reason StopReason) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.reason == StopReasonNone {
+		s.reason = reason
+	}
+}
+
+// giveUp records that supervision ended because the supervisor gave up on the
+// panic r, recovered from the invocation identified by attempt, with err,
+// unless a reason was already recorded.
+func (s *Supervisor) giveUp(reason StopReason, attempt int, r interface{}, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.reason == StopReasonNone {
+		s.reason = reason
+		s.finalPanic = r
+		s.giveUpErr = err
+		s.giveUpAt = attempt
+	}
+}
+
+// giveUpReturned is like giveUp but for a value returned by the worker, which
+// isn't recorded as the final panic.
+func (s *Supervisor) giveUpReturned(reason StopReason, attempt int, r interface{}) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.reason == StopReasonNone {
+		s.reason = reason
+		s.giveUpErr = fmt.Errorf("reroutine: gave up (%s): worker returned %v", reason, r)
+		s.giveUpAt = attempt
+	}
+}
+
+// terminalPanic returns the panic that the supervisor gave up on, if any.
+func (s *Supervisor) terminalPanic() interface{} {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.finalPanic
+}
+
+// stopReason returns why supervision ended, or StopReasonNone if it hasn't.
+func (s *Supervisor) stopReason() StopReason {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.reason
+}
+
+// backOff waits for delay and then for the restart limiters before a restart,
+// returning false if stop is closed first.
+func (s *Supervisor) backOff(delay time.Duration, stop <-chan struct{}) bool {
+	s.setBackingOff(true)
+	defer s.setBackingOff(false)
+	return s.sleepBackoff(delay, stop) && s.waitRestart(stop) && s.acquireRestart(stop)
+}
+
+// sleepBackoff is like sleep but records when it ends for NextRestart.
+func (s *Supervisor) sleepBackoff(d time.Duration, stop <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	begin := s.opts.clock.Now()
+	s.m.Lock()
+	s.nextRestart = begin.Add(d)
+	s.m.Unlock()
+	defer func() {
+		slept := s.opts.clock.Now().Sub(begin)
+		if slept < 0 {
+			slept = 0
+		}
+		s.m.Lock()
+		s.nextRestart = time.Time{}
+		s.backoffTime += slept
+		s.m.Unlock()
+		if s.opts.metrics != nil {
+			s.opts.metrics.AddBackoff(s.opts.name, slept)
+		}
+	}()
+	return s.sleep(d, stop)
+}
+
+// NextRestart returns when the worker will be restarted while the supervisor
+// is waiting out the backoff before restarting it, and false otherwise,
+// including once the wait was cut short by stopping. The restart may still be
+// delayed past that time by rate limits, see WithRestartRate.
+func (s *Supervisor) NextRestart() (at time.Time, ok bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.nextRestart, !s.nextRestart.IsZero()
+}
+
+func (s *Supervisor) setBackingOff(backingOff bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.backingOff = backingOff
+}
+
+// waitRestart blocks until the global restart limiter and the supervisor's own
+// limiter, if any, allow another restart. It returns false if stop is closed
+// while waiting.
+func (s *Supervisor) waitRestart(stop <-chan struct{}) bool {
+	if global := getGlobalLimiter(); global != nil && !global.wait(1, stop, s.opts.clock) {
+		return false
+	}
+	if s.opts.limiter == nil {
+		return true
+	}
+	return s.opts.limiter.wait(s.opts.cost, stop, s.opts.clock)
+}
+
+// handleCrash is deferred around each invocation of the worker. If the worker
+// panicked, the panic is logged along with the restart decision, the panic
+// handlers are run, and either restart is called with the delay before the
+// restart or stop is called with an error describing the panic, depending on
+// that decision.
+func (s *Supervisor) handleCrash(attempt int, restart func(delay time.Duration), stop func(err error)) {
+	if r := recover(); r != nil {
+		s.disarmStable()
+		if s.opts.transform != nil {
+			r = s.opts.transform(r)
+		}
+		info := s.panicInfo(attempt, r)
+		s.recordPanicTime(info.Time)
+		handlers := s.ctxHandlers[:len(s.ctxHandlers):len(s.ctxHandlers)]
+		if s.opts.onPanic != nil {
+			handlers = append(handlers, func(interface{}) {
+				s.opts.onPanic(info)
+			})
+		}
+		delay, reason := s.decide(attempt, r)
+		s.recordPanic(r, reason == StopReasonNone)
+		if s.events != nil {
+			s.events.emit(panicEvent(attempt, reason, info))
+		}
+		s.writePanicEvent(attempt, r, delay, reason)
+		var note string
+		if reason == StopReasonNone {
+			note = s.restartNote(attempt)
+		} else {
+			note = giveUpNote(attempt, reason)
+			err := s.giveUpError(reason, attempt, r, info.Stack)
+			s.giveUp(reason, attempt, r, err)
+			// Only signal the supervisor once the panic has been handled, but
+			// still do so if the panic is re-raised below.
+			defer stop(err)
+		}
+		if info.Panics > 1 {
+			note = fmt.Sprintf("panicked %d times while unwinding, only the last value was recovered; %s", info.Panics, note)
+		}
+		handlePanic(r, reason == StopReasonCrash, s.logPanic(info, note), handlers)
+		if reason == StopReasonNone {
+			restart(delay)
+		}
+	}
+}
+
+// restartNote describes the restart of the invocation identified by attempt
+// in the log line, counting down the restarts left with WithMaxRestarts.
+func (s *Supervisor) restartNote(attempt int) string {
+	note := fmt.Sprintf("restarting (attempt %d)", attempt+1)
+	if max := s.opts.maxRestarts; max > 0 {
+		note += fmt.Sprintf("; restart %d of %d, %d remaining", attempt, max, max-attempt)
+	}
+	return note
+}
+
+// giveUpNote describes giving up on the invocation identified by attempt for
+// reason in the log line, saying how many attempts were made when they ran
+// out.
+func giveUpNote(attempt int, reason StopReason) string {
+	note := fmt.Sprintf("giving up (attempt %d): %s", attempt, reason)
+	if reason == StopReasonMaxRestarts {
+		note += fmt.Sprintf(" after %d attempts", attempt)
+	}
+	return note
+}
+
+// recordPanic records r as the last panic, or as the last value passed to
+// restartReturned, counting a restart if restarting.
+func (s *Supervisor) recordPanic(r interface{}, restarting bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.lastPanic = r
+	if restarting {
+		s.restarts++
+	}
+}
+
+// panicHistory is the number of panic times kept for PanicRate.
+const panicHistory = 64
+
+// recordPanicTime records that a panic was recovered at t.
+func (s *Supervisor) recordPanicTime(t time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.panicTimes[s.panicCount%panicHistory] = t
+	s.panicCount++
+}
+
+// PanicRate returns the number of panics per second over the trailing window.
+// Only the most recent 64 panics are remembered, so the rate is capped at 64
+// panics per window.
+func (s *Supervisor) PanicRate(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	since := s.opts.clock.Now().Add(-window)
+	s.m.Lock()
+	defer s.m.Unlock()
+	n := 0
+	for i := 0; i < s.panicCount && i < panicHistory; i++ {
+		if s.panicTimes[i].After(since) {
+			n++
+		}
+	}
+	return float64(n) / window.Seconds()
+}
+
+// giveUpError returns the error describing why the supervisor gave up on the
+// panic r, recovered from the invocation identified by attempt.
+func (s *Supervisor) giveUpError(reason StopReason, attempt int, r interface{}, stack []byte) error {
+	switch reason {
+	case StopReasonMaxRestarts:
+		return &MaxRestartsError{Attempts: attempt, LastPanic: r, Stack: stack}
+	case StopReasonBudgetExceeded:
+		return &BudgetExceededError{
+			Budget:    s.opts.budget,
+			Elapsed:   s.opts.clock.Now().Sub(s.begin),
+			LastPanic: r,
+			Stack:     stack,
+		}
+	default:
+		return &PanicError{Value: r, Stack: stack}
+	}
+}
+
+// logPanic returns the supervisor's replacement for the default logPanic
+// handler, which logs info along with note.
+func (s *Supervisor) logPanic(info PanicInfo, note string) func(interface{}) {
+	repeat := s.repeat(info.Time)
+	return func(r interface{}) {
+		if r == http.ErrAbortHandler || (s.opts.logFilter != nil && !s.opts.logFilter(r)) {
+			return
+		}
+		if s.isVerbose() {
+			logPanicNote(r, captureAllStacks(), note)
+			return
+		}
+		if repeat > 0 {
+			logRepeat := s.opts.logRepeat
+			if logRepeat == nil {
+				logRepeat = printError
+			}
+			logRepeat(formatPanic(r, nil, fmt.Sprintf("%s; repeat %d within %v", note, repeat, s.opts.repeatWindow)))
+			return
+		}
+		var stack []byte
+		if s.opts.logStack {
+			stack = info.Stack
+		}
+		logPanicNote(r, stack, note)
+	}
+}
+
+// repeat returns how many panics preceded the one recovered at t in the
+// current burst of panics, as configured with WithRepeatLogging, or zero if
+// it's the first.
+func (s *Supervisor) repeat(t time.Time) int {
+	if s.opts.repeatWindow <= 0 {
+		return 0
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.burst > 0 && t.Sub(s.lastPanicTime) <= s.opts.repeatWindow {
+		s.burst++
+	} else {
+		s.burst = 1
+	}
+	s.lastPanicTime = t
+	return s.burst - 1
+}
+
+// finalize disarms the stable timer and runs the finalizer, if any.
+func (s *Supervisor) finalize() {
+	deregister(s)
+	// Stopped before the restart the semaphore was acquired for began.
+	s.releaseRestart()
+	s.m.Lock()
+	// An invocation left running after stop must not re-arm the timer.
+	s.finalized = true
+	s.disarmStableLocked()
+	if s.opts.stopIsError && s.reason == StopReasonStopped && s.err == nil {
+		s.err = ErrStopped
+	}
+	reason, err, attempt := s.reason, s.giveUpErr, s.giveUpAt
+	s.m.Unlock()
+	callback("finalizer", s.opts.finalizer)
+	s.events.emit(Event{Kind: EventStop, Reason: reason, Time: s.opts.clock.Now()})
+	s.writeEvent(jsonEvent{Event: "stop", Reason: reason.String()})
+	s.events.close()
+	if s.opts.onGiveUp == nil || err == nil {
+		s.notified.fire()
+		return
+	}
+	s.m.Lock()
+	s.pendingCallbacks++
+	s.m.Unlock()
+	spawn(func() {
+		defer s.notified.fire()
+		defer func() {
+			s.m.Lock()
+			s.pendingCallbacks--
+			s.m.Unlock()
+		}()
+		ctx := context.WithValue(context.Background(), attemptKey{}, attempt)
+		callback("give up callback", func() {
+			s.opts.onGiveUp(ctx, reason, err)
+		})
+	})
+}
+
+// flushInterval is how often Flush checks for outstanding work.
+const flushInterval = time.Millisecond
+
+// Flush blocks until the asynchronous work of the supervisor that is under
+// way has completed: the callback configured with WithOnGiveUp, if it's
+// running, and the delivery of the events buffered for Events, which must be
+// received for Flush to return. It doesn't wait for supervision to end. If ctx
+// is done first, it returns an error wrapping ctx.Err() that describes the
+// outstanding work.
+func (s *Supervisor) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		s.m.Lock()
+		callbacks := s.pendingCallbacks
+		s.m.Unlock()
+		events := 0
+		if s.events != nil {
+			events = len(s.events.c)
+		}
+		if callbacks == 0 && events == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("reroutine: flush: %d callbacks and %d events outstanding: %w", callbacks, events, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitGiveUpCallback blocks until supervision has ended and the callback
+// configured with WithOnGiveUp, if it was called, has returned, or until ctx
+// is done, in which case it returns ctx.Err().
+func (s *Supervisor) WaitGiveUpCallback(ctx context.Context) error {
+	select {
+	case <-s.notified.wait():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// armStable starts the timer that marks the supervisor healthy and calls the
+// stable callback, if any, once the invocation that is starting has run for the
+// stability window without panicking.
+func (s *Supervisor) armStable() {
+	if s.opts.onStable == nil && s.opts.stableAfter <= 0 {
+		return
+	}
+	s.m.Lock()
+	if s.finalized {
+		s.m.Unlock()
+		return
+	}
+	t := s.opts.clock.NewTimer(s.opts.stableAfter)
+	disarm := make(chan struct{})
+	s.disarmStableLocked()
+	s.stable = disarm
+	s.m.Unlock()
+	spawn(func() {
+		select {
+		case <-t.C():
+			s.m.Lock()
+			fire := s.stable == disarm
+			if fire {
+				s.stable = nil
+			}
+			s.m.Unlock()
+			if fire {
+				s.markHealthy()
+				callback("stable callback", s.opts.onStable)
+			}
+		case <-disarm:
+			t.Stop()
+		}
+	})
+}
+
+// disarmStable cancels the pending stable timer, if any.
+func (s *Supervisor) disarmStable() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.disarmStableLocked()
+}
+
+func (s *Supervisor) disarmStableLocked() {
+	if s.stable != nil {
+		close(s.stable)
+		s.stable = nil
+	}
+}
+
+// cleanExit runs the clean exit callback, if any.
+func (s *Supervisor) cleanExit() {
+	callback("clean exit callback", s.opts.onCleanExit)
+}
+
+// callback calls fn if it isn't nil, recovering and logging any panic so that
+// a misbehaving callback cannot be mistaken for a panicking worker.
+func callback(name string, fn func()) {
+	if fn == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// Never re-panic here, even with ReallyCrash, as that would leak
+			// the panic to whoever is waiting on the supervisor.
+			runHandlers(r, func(r interface{}) {
+				var stack []byte
+				if LogStackTrace {
+					stack = captureStack()
+				}
+				logPanicNote(r, stack, "in "+name)
+			}, nil)
+		}
+	}()
+	fn()
+}
+
+// outcome is the result of a single invocation of the worker.
+type outcome struct {
+	restart bool
+	delay   time.Duration
+}
+
+// run supervises do until it returns without panicking, the supervisor gives
+// up, or stop is closed. Each invocation of do receives its attempt, starting
+// at one.
+func (s *Supervisor) run(stop <-chan struct{}, do func(attempt int)) {
+	s.resume(stop, 1, 0, do)
+}
+
+// resume is like run but starts supervising at the given attempt, launching it
+// after delay.
+func (s *Supervisor) resume(stop <-chan struct{}, attempt int, delay time.Duration, do func(attempt int)) {
+	defer s.finalize()
+	if attempt == 1 {
+		// Locked, as a handle registers the supervisor before it starts.
+		s.m.Lock()
+		s.begin = s.opts.clock.Now()
+		s.m.Unlock()
+	}
+	register(s)
+	if s.opts.trigger != nil {
+		done := make(chan struct{})
+		defer close(done)
+		spawn(func() {
+			s.watchTrigger(stop, done)
+		})
+	}
+	for ; ; attempt++ {
+		if attempt > 1 && !s.backOff(delay, stop) {
+			s.setReason(StopReasonStopped)
+			return
+		}
+		select {
+		case <-stop:
+			s.setReason(StopReasonStopped)
+			return
+		default:
+		}
+		var o outcome
+		var ok bool
+		if s.opts.inline {
+			o, ok = s.invokeInline(stop, attempt, do)
+		} else {
+			o, ok = s.submit(stop, attempt, do)
+		}
+		if !ok {
+			s.setReason(StopReasonStopped)
+			return
+		}
+		if !o.restart {
+			return
+		}
+		delay = o.delay
+	}
+}
+
+// invokeInline runs the invocation identified by attempt on the calling
+// go-routine, for WithInline, returning false if stop was closed before it
+// could start.
+func (s *Supervisor) invokeInline(stop <-chan struct{}, attempt int, do func(attempt int)) (o outcome, ok bool) {
+	if !s.enterFlight(stop) {
+		return outcome{}, false
+	}
+	s.wrap(func() {
+		defer s.leaveFlight()
+		o = s.invoke(attempt, do)
+	})()
+	return o, true
+}
+
+// invoke runs a single invocation of do on the calling go-routine and returns
+// its outcome.
+func (s *Supervisor) invoke(attempt int, do func(attempt int)) (o outcome) {
+	defer s.handleCrash(attempt, func(delay time.Duration) {
+		o = outcome{restart: true, delay: delay}
+	}, func(error) {
+		o = outcome{}
+	})
+	if s.opts.lockOSThread {
+		// Deferred after handleCrash so that it runs first, unlocking before
+		// the panic is handled, even if it's re-raised.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	s.releaseRestart()
+	s.resetTrigger()
+	gid := s.markStarted()
+	s.events.emit(Event{Kind: EventStart, Attempt: attempt, Goroutine: gid, Time: s.opts.clock.Now()})
+	s.writeEvent(jsonEvent{Event: "start", Attempt: attempt, Goroutine: gid})
+	s.armStable()
+	replacement := s.replacement()
+	if len(s.opts.middleware) == 0 && !chaos() {
+		// The common case, without the closure the middleware needs.
+		if replacement != nil {
+			replacement()
+		} else {
+			do(attempt)
+		}
+	} else {
+		s.chain(func() {
+			s.panicInjected()
+			if replacement != nil {
+				replacement()
+			} else {
+				do(attempt)
+			}
+			s.panicInjected()
+		})()
+	}
+	if s.takeTrigger() {
+		return s.restartTriggered(attempt)
+	}
+	if replacement == nil {
+		if o, ok := s.restartReturned(attempt); ok {
+			return o
+		}
+	}
+	s.setReason(StopReasonClean)
+	s.markHealthy()
+	s.cleanExit()
+	return outcome{}
+}
+
+// restartRequested decides whether to restart the tomb invocation identified
+// by attempt, which returned err, because err carries a Backoff. It returns
+// false if err doesn't carry one, in which case the invocation is treated as a
+// clean exit.
+func (s *Supervisor) restartRequested(attempt int, err error) (outcome, bool) {
+	if _, ok := requestedBackoff(err); !ok {
+		return outcome{}, false
+	}
+	s.disarmStable()
+	delay, reason := s.decideRestart(attempt, err)
+	s.recordPanic(err, reason == StopReasonNone)
+	if reason != StopReasonNone {
+		s.giveUpReturned(reason, attempt, err)
+		printError(fmt.Sprintf("Worker returned %v; %s", err, giveUpNote(attempt, reason)))
+		return outcome{}, true
+	}
+	printError(fmt.Sprintf("Worker returned %v; %s", err, s.restartNote(attempt)))
+	return outcome{restart: true, delay: delay}, true
+}
+
+// watchTrigger interrupts the running invocation whenever a value is received
+// on the restart trigger, until stop or done is closed. With
+// WithTriggerDebounce, a value only takes effect once no other has been
+// received for the debounce window.
+func (s *Supervisor) watchTrigger(stop, done <-chan struct{}) {
+	trigger := s.opts.trigger
+	var debounce Timer
+	var debounced <-chan time.Time // nil unless a trigger is pending
+	defer func() {
+		if debounce != nil {
+			debounce.Stop()
+		}
+	}()
+	for {
+		select {
+		case _, ok := <-trigger:
+			if !ok {
+				// A nil channel blocks forever, leaving stop, done and a
+				// pending trigger, which still takes effect.
+				trigger = nil
+				continue
+			}
+			if s.opts.triggerDebounce <= 0 {
+				s.fireTrigger()
+				continue
+			}
+			if debounce != nil {
+				debounce.Stop()
+			}
+			debounce = s.opts.clock.NewTimer(s.opts.triggerDebounce)
+			debounced = debounce.C()
+		case <-debounced:
+			debounce, debounced = nil, nil
+			s.fireTrigger()
+		case <-stop:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// fireTrigger interrupts the running invocation for a restart trigger.
+func (s *Supervisor) fireTrigger() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.triggered = true
+	if s.cancelInvocation != nil {
+		s.cancelInvocation()
+	}
+}
+
+// resetTrigger forgets any trigger received before the invocation started.
+func (s *Supervisor) resetTrigger() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.triggered = false
+}
+
+// takeTrigger reports whether a trigger was received while the invocation was
+// running.
+func (s *Supervisor) takeTrigger() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	triggered := s.triggered
+	s.triggered = false
+	return triggered
+}
+
+// invocationContext returns a context derived from parent that is cancelled
+// when the restart trigger fires, or a panic is injected, during the running
+// invocation. The returned function must be called once the invocation
+// returns.
+func (s *Supervisor) invocationContext(parent context.Context) (context.Context, func()) {
+	if s.opts.trigger == nil && !chaos() {
+		return parent, func() {}
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.m.Lock()
+	if s.triggered || s.injected != nil {
+		cancel()
+	}
+	s.cancelInvocation = cancel
+	s.m.Unlock()
+	return ctx, func() {
+		s.m.Lock()
+		s.cancelInvocation = nil
+		s.m.Unlock()
+		cancel()
+	}
+}
+
+// restartTriggered restarts the invocation identified by attempt, which
+// returned after the restart trigger fired, without backing off.
+func (s *Supervisor) restartTriggered(attempt int) outcome {
+	s.disarmStable()
+	s.m.Lock()
+	s.triggeredRestarts++
+	s.m.Unlock()
+	printError(fmt.Sprintf("Restart triggered; restarting (attempt %d)", attempt+1))
+	return outcome{restart: true}
+}
+
+// restartReturned decides whether to restart the invocation identified by
+// attempt even though it returned without panicking, as requested by
+// s.returned. It returns false if the invocation should be treated as a clean
+// exit.
+func (s *Supervisor) restartReturned(attempt int) (outcome, bool) {
+	if s.returned == nil {
+		return outcome{}, false
+	}
+	r, restart := s.returned()
+	if !restart {
+		return outcome{}, false
+	}
+	s.disarmStable()
+	delay, reason := s.decideRestart(attempt, r)
+	s.recordPanic(r, reason == StopReasonNone)
+	if reason != StopReasonNone {
+		s.giveUpReturned(reason, attempt, r)
+		printError(fmt.Sprintf("Worker returned %v; %s", r, giveUpNote(attempt, reason)))
+		return outcome{}, true
+	}
+	printError(fmt.Sprintf("Worker returned %v; %s", r, s.restartNote(attempt)))
+	return outcome{restart: true, delay: delay}, true
+}
+
+// submit is like invoke but runs the invocation on another go-routine using
+// the configured executor. It returns false if stop is closed before the
+// invocation finishes, in which case the invocation is left running, or is
+// skipped if it is still queued. The outcome channel is buffered so that an
+// abandoned invocation can always report its outcome without blocking.
+func (s *Supervisor) submit(stop <-chan struct{}, attempt int, do func(attempt int)) (outcome, bool) {
+	outcomes := make(chan outcome, 1)
+	s.opts.executor.Submit(s.wrap(func() {
+		select {
+		case <-stop:
+			// Stopped while the invocation was queued
+			return
+		default:
+		}
+		if !s.enterFlight(stop) {
+			return
+		}
+		defer s.leaveFlight()
+		outcomes <- s.invoke(attempt, do)
+	}))
+	select {
+	case <-stop:
+		// A worker that returned as stop was closed has ended supervision by
+		// itself, so its outcome wins if it's already been reported.
+		select {
+		case o := <-outcomes:
+			return o, true
+		default:
+			return outcome{}, false
+		}
+	case o := <-outcomes:
+		return o, true
+	}
+}
+
+// enterFlight waits until no other invocation of the worker is running, when
+// WithSingleFlight is set, returning false if stop is closed first.
+func (s *Supervisor) enterFlight(stop <-chan struct{}) bool {
+	if s.opts.flight == nil {
+		return true
+	}
+	select {
+	case s.opts.flight <- struct{}{}:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// leaveFlight lets the next invocation start after enterFlight returned true.
+func (s *Supervisor) leaveFlight() {
+	if s.opts.flight != nil {
+		<-s.opts.flight
+	}
+}
+
+// runTomb is like run but launches each invocation of do using the tomb and
+// stops once the tomb is dying. When the supervisor gives up on a panic, the
+// invocation returns a *PanicError so that the tomb is killed with it.
+func (s *Supervisor) runTomb(ts Tomb, do func(attempt int) error) {
+	defer s.finalize()
+	s.begin = s.opts.clock.Now()
+	register(s)
+	killer, reporter := tombCapabilities(ts)
+	dying := func() {
+		s.setReason(StopReasonStopped)
+		if reporter != nil {
+			s.setErr(reporter.Err())
+		}
+	}
+	outcomes := make(chan outcome, 1)
+	var delay time.Duration
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ts.Dying():
+			dying()
+			return
+		default:
+		}
+		if attempt > 1 && !s.backOff(delay, ts.Dying()) {
+			dying()
+			return
+		}
+		attempt := attempt
+		ts.Go(func() (err error) {
+			s.wrap(func() {
+				err = s.invokeTomb(attempt, do, outcomes, killer)
+			})()
+			return err
+		})
+		o := <-outcomes
+		if !o.restart {
+			return
+		}
+		delay = o.delay
+	}
+}
+
+// invokeTomb runs a single invocation of a tomb worker and reports its outcome
+// on outcomes. killer is the tomb, if it implements Killer.
+func (s *Supervisor) invokeTomb(attempt int, do func(attempt int) error, outcomes chan<- outcome, killer Killer) (err error) {
+	defer s.handleCrash(attempt, func(delay time.Duration) {
+		outcomes <- outcome{restart: true, delay: delay}
+	}, func(panicErr error) {
+		// Giving up, so kill the tomb with the reason.
+		err = panicErr
+		if killer != nil {
+			killer.Kill(panicErr)
+		}
+		outcomes <- outcome{}
+	})
+	if s.opts.lockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	s.releaseRestart()
+	gid := s.markStarted()
+	s.events.emit(Event{Kind: EventStart, Attempt: attempt, Goroutine: gid, Time: s.opts.clock.Now()})
+	s.writeEvent(jsonEvent{Event: "start", Attempt: attempt, Goroutine: gid})
+	s.armStable()
+	s.chain(func() {
+		s.panicInjected()
+		err = do(attempt)
+		s.panicInjected()
+	})()
+	if o, ok := s.restartRequested(attempt, err); ok {
+		outcomes <- o
+		if o.restart {
+			return nil
+		}
+		return err
+	}
+	// Function completed without panic, don't restart
+	s.setReason(StopReasonClean)
+	s.markHealthy()
+	s.cleanExit()
+	outcomes <- outcome{}
+	return err
+}
+
+// chain wraps f in the middleware, the first one outermost.
+func (s *Supervisor) chain(f func()) func() {
+	for i := len(s.opts.middleware) - 1; i >= 0; i-- {
+		f = s.opts.middleware[i](f)
+	}
+	return f
+}
+
+// wrap applies the pprof labels and the go-routine wrapper, if any, to f.
+func (s *Supervisor) wrap(f func()) func() {
+	if s.opts.hasLabels {
+		labelled := f
+		f = func() {
+			pprof.Do(context.Background(), s.opts.labels, func(context.Context) {
+				labelled()
+			})
+		}
+	}
+	if s.opts.wrapper == nil {
+		return f
+	}
+	return s.opts.wrapper(f)
+}
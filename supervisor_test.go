@@ -0,0 +1,701 @@
+package reroutine
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisor_Backoff(t *testing.T) {
+	s := newSupervisor([]Option{WithBackoff(time.Second, 5*time.Second)})
+	for restarts, expected := range []time.Duration{0, 1, 2, 4, 5, 5} {
+		if restarts == 0 {
+			continue
+		}
+		if d := s.backoff(restarts); d != expected*time.Second {
+			t.Errorf("expected backoff of %v after %d restarts, got %v", expected*time.Second, restarts, d)
+		}
+	}
+	if d := newSupervisor(nil).backoff(3); d != 0 {
+		t.Errorf("expected no backoff by default, got %v", d)
+	}
+}
+
+func TestSupervisor_RetryBudget(t *testing.T) {
+	t.Run("Elapsed", func(t *testing.T) {
+		h := Go(nil, func() {
+			time.Sleep(10 * time.Millisecond)
+			panic("panicked")
+		}, WithRetryBudget(50*time.Millisecond))
+		h.Wait()
+		if h.Reason() != StopReasonBudgetExceeded {
+			t.Errorf("expected budget to be exceeded, got %v", h.Reason())
+		}
+	})
+	t.Run("Backoff longer than budget", func(t *testing.T) {
+		start := time.Now()
+		var i int32
+		h := Go(nil, func() {
+			atomic.AddInt32(&i, 1)
+			panic("panicked")
+		}, WithRetryBudget(50*time.Millisecond), WithBackoff(time.Hour, 0))
+		h.Wait()
+		if h.Reason() != StopReasonBudgetExceeded {
+			t.Errorf("expected budget to be exceeded, got %v", h.Reason())
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+			t.Errorf("expected to sleep until the budget ran out, slept %v", elapsed)
+		}
+		if n := atomic.LoadInt32(&i); n != 2 {
+			t.Errorf("expected a last restart as the budget ran out, got %d invocations", n)
+		}
+	})
+	t.Run("Backoff clamped to remaining budget", func(t *testing.T) {
+		clock := newFakeClock()
+		s := newSupervisor([]Option{WithClock(clock), WithRetryBudget(time.Minute), WithBackoff(time.Hour, 0)})
+		s.begin = clock.Now()
+		clock.Advance(40 * time.Second)
+		if delay, reason := s.decide(1, "panicked"); reason != StopReasonNone || delay != 20*time.Second {
+			t.Errorf("expected the backoff to be clamped to 20s, got %v (%v)", delay, reason)
+		}
+		clock.Advance(20 * time.Second)
+		if delay, reason := s.decide(2, "panicked"); reason != StopReasonBudgetExceeded || delay != 0 {
+			t.Errorf("expected to give up immediately without budget, got %v (%v)", delay, reason)
+		}
+	})
+}
+
+func TestSupervisor_FinalPanic(t *testing.T) {
+	var i int32
+	h := Go(nil, func() {
+		panic(atomic.AddInt32(&i, 1))
+	}, WithMaxRestarts(2))
+	h.Wait()
+	if h.FinalPanic() != int32(3) {
+		t.Errorf("expected the third panic, got %v", h.FinalPanic())
+	}
+	h = Go(nil, func() {})
+	h.Wait()
+	if h.FinalPanic() != nil {
+		t.Errorf("expected no final panic after a clean exit, got %v", h.FinalPanic())
+	}
+}
+
+func TestSupervisor_StopReason(t *testing.T) {
+	t.Run("Clean", func(t *testing.T) {
+		h := Go(nil, func() {})
+		if h.Reason() != StopReasonNone && h.Reason() != StopReasonClean {
+			t.Errorf("unexpected reason %v", h.Reason())
+		}
+		h.Wait()
+		if h.Reason() != StopReasonClean {
+			t.Errorf("expected clean exit, got %v", h.Reason())
+		}
+	})
+	t.Run("Stopped", func(t *testing.T) {
+		h := Go(nil, func() {
+			panic("panicked")
+		}, WithBackoff(time.Hour, 0))
+		h.Stop()
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Errorf("expected stopped, got %v", h.Reason())
+		}
+	})
+	t.Run("Max restarts", func(t *testing.T) {
+		h := Go(nil, func() {
+			panic("panicked")
+		}, WithMaxRestarts(1))
+		h.Wait()
+		if h.Reason() != StopReasonMaxRestarts {
+			t.Errorf("expected max restarts, got %v", h.Reason())
+		}
+	})
+	t.Run("Callback aborted", func(t *testing.T) {
+		var restarts []int
+		h := Go(nil, func() {
+			panic("panicked")
+		}, WithRestartHook(func(attempt int, recovered interface{}) bool {
+			restarts = append(restarts, attempt)
+			return attempt < 3
+		}))
+		h.Wait()
+		if h.Reason() != StopReasonCallbackAborted {
+			t.Errorf("expected callback aborted, got %v", h.Reason())
+		}
+		if len(restarts) != 3 || restarts[2] != 3 {
+			t.Errorf("expected the hook to be called for each attempt, got %v", restarts)
+		}
+	})
+}
+
+func TestSupervisor_CleanExitStopRace(t *testing.T) {
+	t.Run("Inline", func(t *testing.T) {
+		// The invocation runs on the supervising go-routine, so its clean exit
+		// is always seen before the stop.
+		stop := make(chan struct{})
+		var starts int32
+		h := Go(stop, func() {
+			atomic.AddInt32(&starts, 1)
+			close(stop)
+		}, WithInline())
+		h.Wait()
+		if h.Reason() != StopReasonClean || atomic.LoadInt32(&starts) != 1 {
+			t.Errorf("expected a single clean exit, got %v after %d starts", h.Reason(), starts)
+		}
+	})
+	t.Run("Stress", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			stop := make(chan struct{})
+			release := make(chan struct{})
+			var starts, finalized int32
+			h := Go(stop, func() {
+				atomic.AddInt32(&starts, 1)
+				<-release
+			}, WithFinalizer(func() {
+				atomic.AddInt32(&finalized, 1)
+			}))
+			<-h.Started()
+			// Return cleanly and stop at the same moment.
+			close(release)
+			close(stop)
+			h.Wait()
+			if reason := h.Reason(); reason != StopReasonClean && reason != StopReasonStopped {
+				t.Fatalf("expected a clean exit or a stop, got %v", reason)
+			}
+			if stats := h.Stats(); stats.Starts != 1 || stats.Restarts != 0 || atomic.LoadInt32(&starts) != 1 {
+				t.Fatalf("expected the worker never to be relaunched after returning, got %+v", stats)
+			}
+			if atomic.LoadInt32(&finalized) != 1 {
+				t.Fatalf("expected supervision to end once, got %d finalizations", finalized)
+			}
+		}
+	})
+}
+
+func TestSupervisor_OnRestart(t *testing.T) {
+	var restarts int
+	BlockingGo(nil, func() {
+		if restarts < 2 {
+			panic("panicked")
+		}
+	}, WithOnRestart(func(attempt int, recovered interface{}) {
+		if recovered != "panicked" || attempt != restarts+1 {
+			t.Errorf("unexpected restart of attempt %d with %v", attempt, recovered)
+		}
+		restarts++
+	}))
+	if restarts != 2 {
+		t.Errorf("expected 2 restarts, got %d", restarts)
+	}
+}
+
+func TestSupervisor_RequestedBackoff(t *testing.T) {
+	s := newSupervisor([]Option{WithBackoff(time.Hour, 0)})
+	for _, r := range []interface{}{
+		Backoff{Duration: time.Second},
+		&Backoff{Duration: time.Second},
+		fmt.Errorf("rate limited: %w", Backoff{Duration: time.Second}),
+	} {
+		if delay, reason := s.decide(1, r); reason != StopReasonNone || delay != time.Second {
+			t.Errorf("expected %v to request a one second delay, got %v (%v)", r, delay, reason)
+		}
+	}
+	if delay, _ := s.decide(1, "panicked"); delay != time.Hour {
+		t.Errorf("expected configured backoff, got %v", delay)
+	}
+	if delay, _ := s.decide(1, (*Backoff)(nil)); delay != time.Hour {
+		t.Errorf("expected a nil *Backoff to use the configured backoff, got %v", delay)
+	}
+
+	t.Run("Nil pointer", func(t *testing.T) {
+		captureLogs(t)
+		h := Go(nil, func() {
+			panic((*Backoff)(nil))
+		}, WithMaxRestarts(1))
+		h.Wait()
+		if h.Reason() != StopReasonMaxRestarts {
+			t.Errorf("expected a nil *Backoff panic to be recovered, got %v", h.Reason())
+		}
+	})
+	t.Run("Returned", func(t *testing.T) {
+		logs := captureLogs(t)
+		clock := newFakeClock()
+		var ts mockTomb
+		var i int32
+		finished := make(chan struct{})
+		ts.Go(func() error {
+			<-finished
+			return nil
+		})
+		GoTomb(&ts, func() error {
+			if atomic.AddInt32(&i, 1) == 1 {
+				return fmt.Errorf("rate limited: %w", Backoff{Duration: time.Minute})
+			}
+			close(finished)
+			return nil
+		}, WithClock(clock), WithBackoff(time.Hour, 0))
+		<-clock.added
+		clock.Advance(time.Minute)
+		if err := ts.Wait(); err != nil {
+			t.Fatalf("expected the returned Backoff not to kill the tomb, got %v", err)
+		}
+		if n := atomic.LoadInt32(&i); n != 2 {
+			t.Errorf("expected the worker to be restarted after the requested delay, got %d invocations", n)
+		}
+		if lines := logs(); len(lines) != 1 || lines[0] != "Worker returned rate limited: reroutine: retry after 1m0s; restarting (attempt 2)" {
+			t.Errorf("unexpected log lines %q", lines)
+		}
+	})
+}
+
+func TestSupervisor_RestartDelay(t *testing.T) {
+	s := newSupervisor([]Option{WithBackoff(time.Hour, 0), WithRestartDelay(func(attempt int, recovered interface{}) time.Duration {
+		if recovered == "overloaded" {
+			return time.Minute
+		}
+		return 0
+	})})
+	for _, tt := range []struct {
+		recovered interface{}
+		expected  time.Duration
+	}{
+		{"overloaded", time.Minute},
+		{"panicked", time.Hour},
+		{Backoff{Duration: time.Second}, time.Second},
+	} {
+		if delay, reason := s.decide(1, tt.recovered); reason != StopReasonNone || delay != tt.expected {
+			t.Errorf("expected %v to be restarted after %v, got %v (%v)", tt.recovered, tt.expected, delay, reason)
+		}
+	}
+
+	s = newSupervisor([]Option{WithRetryBudget(time.Second), WithRestartDelay(func(int, interface{}) time.Duration {
+		return time.Hour
+	})})
+	s.begin = s.opts.clock.Now()
+	if delay, _ := s.decide(1, "panicked"); delay <= 0 || delay > time.Second {
+		t.Errorf("expected the delay to be cut short by the budget, got %v", delay)
+	}
+}
+
+func BenchmarkSupervisor(b *testing.B) {
+	captureLogs(b)
+	defer func(v bool) { LogStackTrace = v }(LogStackTrace)
+	LogStackTrace = false
+
+	b.Run("Launch", func(b *testing.B) {
+		b.ReportAllocs()
+		created := goroutinesCreated()
+		stop := make(chan struct{})
+		for i := 0; i < b.N; i++ {
+			BlockingGo(stop, func() {})
+		}
+		reportGoroutines(b, created)
+	})
+	b.Run("Launch Go", func(b *testing.B) {
+		b.ReportAllocs()
+		created := goroutinesCreated()
+		for i := 0; i < b.N; i++ {
+			Go(nil, func() {}).Wait()
+		}
+		reportGoroutines(b, created)
+	})
+	b.Run("Launch tomb", func(b *testing.B) {
+		b.ReportAllocs()
+		created := goroutinesCreated()
+		for i := 0; i < b.N; i++ {
+			BlockingGoTomb(benchTomb{}, func() error { return nil })
+		}
+		reportGoroutines(b, created)
+	})
+	b.Run("Launch handshake", func(b *testing.B) {
+		b.ReportAllocs()
+		stop := make(chan struct{})
+		for i := 0; i < b.N; i++ {
+			newSupervisor(nil).runHandshake(stop, func(int) {})
+		}
+	})
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Restart", nil},
+		{"Restart inline", []Option{WithInline()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			created := goroutinesCreated()
+			i := 0
+			BlockingGo(make(chan struct{}), func() {
+				if i++; i < b.N {
+					panic("panicked")
+				}
+			}, bm.opts...)
+			reportGoroutines(b, created)
+		})
+	}
+	b.Run("Restart tomb", func(b *testing.B) {
+		b.ReportAllocs()
+		created := goroutinesCreated()
+		i := 0
+		BlockingGoTomb(benchTomb{}, func() error {
+			if i++; i < b.N {
+				panic("panicked")
+			}
+			return nil
+		})
+		reportGoroutines(b, created)
+	})
+}
+
+func TestSupervisor_LaunchAllocs(t *testing.T) {
+	// The supervisor, its options, the worker and the invocation's go-routine,
+	// closure and outcome channel.
+	const expected = 6
+	stop := make(chan struct{})
+	if allocs := testing.AllocsPerRun(100, func() {
+		BlockingGo(stop, func() {})
+	}); allocs > expected {
+		t.Errorf("expected at most %d allocations per launch, got %v", expected, allocs)
+	}
+}
+
+// benchTomb is a Tomb that is never killed and doesn't track its go-routines,
+// so that benchmarks only measure the supervisor.
+type benchTomb struct{}
+
+func (benchTomb) Dying() <-chan struct{} { return nil }
+func (benchTomb) Go(f func() error)      { go f() }
+
+// reportGoroutines reports the number of go-routines created per operation
+// since created was sampled with goroutinesCreated, if the runtime reports it.
+func reportGoroutines(b *testing.B, created int64) {
+	if created >= 0 {
+		b.ReportMetric(float64(goroutinesCreated()-created)/float64(b.N), "goroutines/op")
+	}
+}
+
+// runHandshake is the start-channel supervisor loop that run replaced, kept so
+// that the two can be benchmarked against each other.
+func (s *Supervisor) runHandshake(stop <-chan struct{}, do func(attempt int)) {
+	start := make(chan time.Duration)
+	go func() {
+		start <- 0
+	}()
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-stop:
+			return
+		case delay, ok := <-start:
+			if !ok {
+				return
+			}
+			if !s.sleep(delay, stop) {
+				return
+			}
+			go func(attempt int) {
+				defer s.handleCrash(attempt, func(delay time.Duration) {
+					select {
+					case start <- delay:
+					case <-stop:
+					}
+				}, func(error) {
+					close(start)
+				})
+				do(attempt)
+				close(start)
+			}(attempt)
+		}
+	}
+}
+
+// goroutinesCreated returns the number of go-routines created by the process so
+// far, or -1 if the runtime doesn't report it.
+func goroutinesCreated() int64 {
+	sample := []metrics.Sample{{Name: "/sched/goroutines-created:goroutines"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return -1
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+func TestSupervisor_Inline(t *testing.T) {
+	t.Run("Restart", func(t *testing.T) {
+		i := 0
+		BlockingGo(make(chan struct{}), func() {
+			if i++; i < 3 {
+				panic("panicked")
+			}
+		}, WithInline())
+		if i != 3 {
+			t.Error("expected three iterations")
+		}
+	})
+	t.Run("Stop waits for invocation", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		h := Go(nil, func() {
+			close(started)
+			<-release
+			panic("panicked")
+		}, WithInline())
+		<-started
+		h.Stop()
+		if err := h.WaitContext(timeout(t, 10*time.Millisecond)); err == nil {
+			t.Error("expected Wait to block until the invocation returned")
+		}
+		close(release)
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Errorf("expected stopped, got %v", h.Reason())
+		}
+	})
+}
+
+// timeout returns a context that expires after d.
+func timeout(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	added  chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), added: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, t)
+	c.added <- struct{}{}
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that expires.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+func (t *fakeTimer) Stop() bool          { return true }
+
+func TestSupervisor_Run(t *testing.T) {
+	clock := newFakeClock()
+	var i int32
+	s := NewSupervisor(func() {
+		if atomic.AddInt32(&i, 1) == 1 {
+			panic("panicked")
+		}
+	}, WithBackoff(time.Hour, 0), WithClock(clock))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(nil)
+	}()
+
+	<-clock.added
+	if atomic.LoadInt32(&i) != 1 || s.Reason() != StopReasonNone {
+		t.Fatal("expected the supervisor to be backing off")
+	}
+	clock.Advance(time.Hour)
+	<-done
+	if atomic.LoadInt32(&i) != 2 || s.Reason() != StopReasonClean {
+		t.Errorf("expected a clean exit after restarting, got %v", s.Reason())
+	}
+}
+
+func TestSupervisor_SingleFlight(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		var running, overlaps int32
+		started := make(chan struct{}, 2)
+		release := make(chan struct{})
+		do := func() {
+			if atomic.AddInt32(&running, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			defer atomic.AddInt32(&running, -1)
+			started <- struct{}{}
+			<-release
+		}
+		opts := []Option{WithSingleFlight()}
+		if inline {
+			opts = append(opts, WithInline())
+		}
+
+		stop := make(chan struct{})
+		first := Go(stop, do, opts...)
+		<-started
+		close(stop)
+		if !inline {
+			first.Wait()
+		}
+		second := Go(nil, do, opts...)
+		select {
+		case <-started:
+			t.Error("expected the second invocation to wait for the first")
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(release)
+		first.Wait()
+		second.Wait()
+		if atomic.LoadInt32(&overlaps) != 0 || second.Reason() != StopReasonClean {
+			t.Errorf("inline %v: expected the invocations not to overlap, got %d overlaps and %v", inline, overlaps, second.Reason())
+		}
+	}
+
+	t.Run("Stop while waiting", func(t *testing.T) {
+		flight := WithSingleFlight()
+		release := make(chan struct{})
+		defer close(release)
+		started := make(chan struct{})
+		Go(nil, func() {
+			close(started)
+			<-release
+		}, flight)
+		<-started
+		h := Go(nil, func() {
+			t.Error("expected the waiting invocation to be abandoned")
+		}, flight)
+		h.Stop()
+		h.Wait()
+		if h.Reason() != StopReasonStopped {
+			t.Errorf("expected stopped, got %v", h.Reason())
+		}
+	})
+}
+
+func TestSupervisor_OnStable(t *testing.T) {
+	clock := newFakeClock()
+	stable := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var i int32
+	h := Go(nil, func() {
+		<-release
+		if atomic.AddInt32(&i, 1) == 1 {
+			panic("panicked")
+		}
+		select {}
+	}, WithClock(clock), WithOnStable(time.Minute, func() {
+		stable <- struct{}{}
+	}))
+	defer h.Stop()
+
+	<-clock.added
+	clock.Advance(30 * time.Second)
+	release <- struct{}{}
+	<-clock.added
+	clock.Advance(30 * time.Second)
+	select {
+	case <-stable:
+		t.Fatal("expected the panic to re-arm the stable timer")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(30 * time.Second)
+	close(release)
+	select {
+	case <-stable:
+	case <-time.After(time.Second):
+		t.Fatal("expected the worker to become stable")
+	}
+	clock.Advance(time.Hour)
+	select {
+	case <-stable:
+		t.Error("expected the stable callback to fire only once")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestSupervisor_ReallyCrash(t *testing.T) {
+	captureLogs(t)
+	defer func(v bool) { ReallyCrash = v }(ReallyCrash)
+	t.Run("Override to crash", func(t *testing.T) {
+		ReallyCrash = false
+		s := newSupervisor([]Option{WithReallyCrash(true)})
+		var r interface{}
+		func() {
+			defer func() {
+				r = recover()
+			}()
+			s.invoke(1, func(int) {
+				panic("panicked")
+			})
+		}()
+		if r != "panicked" || s.Reason() != StopReasonCrash {
+			t.Errorf("expected the panic to be re-raised, got %v (%v)", r, s.Reason())
+		}
+	})
+	t.Run("Override to restart", func(t *testing.T) {
+		ReallyCrash = true
+		i := 0
+		BlockingGo(nil, func() {
+			if i++; i < 3 {
+				panic("panicked")
+			}
+		}, WithReallyCrash(false))
+		if i != 3 {
+			t.Errorf("expected to restart despite ReallyCrash, got %d invocations", i)
+		}
+	})
+}
+
+func TestSupervisor_PanicRate(t *testing.T) {
+	captureLogs(t)
+	clock := newFakeClock()
+	s := newSupervisor([]Option{WithClock(clock)})
+	panics := func(n int) {
+		for i := 0; i < n; i++ {
+			s.invoke(1, func(int) {
+				panic("panicked")
+			})
+		}
+	}
+	panics(10)
+	clock.Advance(5 * time.Second)
+	panics(5)
+	if rate := s.PanicRate(time.Second); rate != 5 {
+		t.Errorf("expected 5 panics per second over the last second, got %v", rate)
+	}
+	if rate := s.PanicRate(10 * time.Second); rate != 1.5 {
+		t.Errorf("expected 1.5 panics per second over the last 10 seconds, got %v", rate)
+	}
+	panics(100)
+	if rate := s.PanicRate(time.Second); rate != panicHistory {
+		t.Errorf("expected the rate to be capped at %d, got %v", panicHistory, rate)
+	}
+}